@@ -1,15 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	app "ap-server/pkg/app"
 	handlers "ap-server/pkg/handlers"
 	middlewares "ap-server/pkg/middlewares"
+	utils "ap-server/pkg/utils"
 
 	_ "github.com/mattn/go-sqlite3" // blank import for db initialization
 
@@ -28,7 +35,10 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func dbSetUp() *sql.DB {
-	os.Remove("./ap-server.db")
+	// the db is kept across restarts (scheduled posts, followers, etc.) unless a reset is asked for
+	if os.Getenv("RESET_DB") == "true" {
+		os.Remove("./ap-server.db")
+	}
 	db, err := sql.Open("sqlite3", "./ap-server.db")
 	if err != nil {
 		log.Fatal(err)
@@ -39,15 +49,296 @@ func dbSetUp() *sql.DB {
 	if err != nil {
 		log.Fatalf("%q: %s\n", err, sqlStmt)
 	}
+	addColumn(db, "accounts", "edpubkey TEXT")
+	addColumn(db, "accounts", "edprivkey TEXT")
+	addColumn(db, "accounts", "status TEXT")
+	addColumn(db, "accounts", "deleted_at TEXT")
+	addColumn(db, "accounts", "created_at TEXT")
+	addColumn(db, "accounts", "apikey_hash TEXT")
+	hashAPIKeys(db)
+	// names are unique regardless of case, older dbs may hold names that only differ in case
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS accounts_name_nocase ON accounts(name COLLATE NOCASE)")
+	if err != nil {
+		log.Println("Not enforcing case-insensitive account names: ", err)
+	}
 	sqlStmt = `CREATE TABLE IF NOT EXISTS messages (guid TEXT PRIMARY KEY, message TEXT)`
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
 		log.Fatalf("%q: %s\n", err, sqlStmt)
 	}
+	// columns added after the table was first created, for dbs kept from older versions
+	addColumn(db, "messages", "account TEXT")
+	addColumn(db, "messages", "type TEXT")
+	addColumn(db, "messages", "object TEXT")
+	addColumn(db, "messages", "published TEXT")
+	backfillPublished(db)
+	sqlStmt = `CREATE TABLE IF NOT EXISTS polls (guid TEXT PRIMARY KEY, account TEXT, multiple INTEGER, end_time TEXT, closed INTEGER, dirty INTEGER)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS poll_votes (poll TEXT, voter TEXT, choice TEXT, PRIMARY KEY (poll, voter, choice))`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS pinned (account TEXT, guid TEXT, pinned_at TEXT, PRIMARY KEY (account, guid))`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS following (account TEXT, target TEXT, follow_id TEXT, accepted INTEGER, PRIMARY KEY (account, target))`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS keys (key_id TEXT PRIMARY KEY, account TEXT, pubkey TEXT, created_at TEXT, retired_at TEXT, expires_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS remote_hosts (host TEXT PRIMARY KEY, sig_format TEXT, updated_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS scheduled_posts (guid TEXT PRIMARY KEY, account TEXT, message TEXT, poll TEXT, scheduled_at TEXT, status TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	addColumn(db, "scheduled_posts", "visibility TEXT")
+	addColumn(db, "scheduled_posts", "error TEXT")
+	sqlStmt = `CREATE TABLE IF NOT EXISTS blocks (account TEXT, target TEXT, block_id TEXT, created_at TEXT, PRIMARY KEY (account, target))`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS reports (id TEXT PRIMARY KEY, origin TEXT, activity_id TEXT, reporter TEXT, target TEXT, account TEXT, objects TEXT, comment TEXT, status TEXT, assigned_to TEXT, created_at TEXT, resolved_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS report_notes (report TEXT, author TEXT, note TEXT, created_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS domain_blocks (domain TEXT PRIMARY KEY, severity TEXT, reject_media INTEGER, reject_reports INTEGER, public_comment TEXT, private_comment TEXT, obfuscate INTEGER, created_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS tokens (id TEXT PRIMARY KEY, account TEXT, name TEXT, hash TEXT UNIQUE, scopes TEXT, created_at TEXT, expires_at TEXT, last_used_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	// tokens issued to OAuth clients, which also get a refresh token
+	addColumn(db, "tokens", "client_id TEXT")
+	addColumn(db, "tokens", "refresh_hash TEXT")
+	sqlStmt = `CREATE TABLE IF NOT EXISTS oauth_clients (client_id TEXT PRIMARY KEY, secret_hash TEXT, name TEXT, redirect_uris TEXT, scopes TEXT, website TEXT, created_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS oauth_codes (hash TEXT PRIMARY KEY, client_id TEXT, account TEXT, redirect_uri TEXT, scopes TEXT, code_challenge TEXT, expires_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS deliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, account TEXT, inbox TEXT, activity_id TEXT, activity_type TEXT, status_code INTEGER, signature_format TEXT, error TEXT, created_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS deliveries_account ON deliveries(account, id)")
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, "deliveries_account")
+	}
+	// what remote actors did to our accounts, an activity is only recorded once per account
+	sqlStmt = `CREATE TABLE IF NOT EXISTS notifications (id INTEGER PRIMARY KEY AUTOINCREMENT, account TEXT, type TEXT, actor TEXT, activity_id TEXT, object TEXT, content TEXT, read INTEGER, created_at TEXT, UNIQUE (account, activity_id))`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS notifications_account ON notifications(account, id)")
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, "notifications_account")
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhooks (id TEXT PRIMARY KEY, account TEXT, url TEXT, events TEXT, secret TEXT, created_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	// the events queued for webhooks, which stay as their delivery log once sent or given up
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhook_deliveries (id TEXT PRIMARY KEY, webhook_id TEXT, account TEXT, event TEXT, payload TEXT, status TEXT, attempts INTEGER, status_code INTEGER, error TEXT, next_attempt_at TEXT, created_at TEXT, delivered_at TEXT)`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at)")
+	if err != nil {
+		log.Fatalf("%q: %s\n", err, "webhook_deliveries_status")
+	}
 
 	return db
 }
 
+// adds a column to an existing table, doing nothing if it is already there
+func addColumn(db *sql.DB, table string, column string) {
+	sqlStmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)
+	_, err := db.Exec(sqlStmt)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		log.Fatalf("%q: %s\n", err, sqlStmt)
+	}
+}
+
+// moves API keys stored in plain text by older versions to apikey_hash, hashed like tokens (hex SHA-256)
+func hashAPIKeys(db *sql.DB) {
+	rows, err := db.Query("SELECT name, apikey FROM accounts WHERE apikey IS NOT NULL AND apikey != ''")
+	if err != nil {
+		log.Fatal(err)
+	}
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var name, apiKey string
+		rows.Scan(&name, &apiKey)
+		sum := sha256.Sum256([]byte(apiKey))
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	rows.Close()
+	for name, hash := range hashes {
+		_, err = db.Exec("UPDATE accounts SET apikey_hash = ?, apikey = NULL WHERE name = ?", hash, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// the timelines page on (published, guid), which rows without published would fall out of, and sort it as text,
+// so older rows take the date of the message itself as RFC 3339 (the notes and polls used to carry an HTTP date),
+// or the empty string to sort before every other post
+func backfillPublished(db *sql.DB) {
+	rows, err := db.Query("SELECT guid, message, published FROM messages WHERE published IS NULL OR (published != '' AND published NOT GLOB '[0-9][0-9][0-9][0-9]-*')")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dates := make(map[string]string)
+	for rows.Next() {
+		var guid string
+		var msgJSONStr []byte
+		var published sql.NullString
+		rows.Scan(&guid, &msgJSONStr, &published)
+		var msg struct {
+			Published string `json:"published"`
+			Object    struct {
+				Published string `json:"published"`
+			} `json:"object"`
+		}
+		json.Unmarshal(msgJSONStr, &msg)
+		dates[guid] = ""
+		for _, date := range []string{published.String, msg.Published, msg.Object.Published} {
+			t, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				t, err = http.ParseTime(date)
+			}
+			if err == nil {
+				dates[guid] = t.UTC().Format(time.RFC3339)
+				break
+			}
+		}
+	}
+	rows.Close()
+	for guid, published := range dates {
+		_, err = db.Exec("UPDATE messages SET published = ? WHERE guid = ?", published, guid)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// creates the key store for the master key in the env var (or its _FILE variant)
+func keyStoreSetUp(envVar string) *utils.KeyStore {
+	masterKey, err := utils.LoadMasterKey(envVar)
+	if err != nil {
+		log.Fatalf("Loading %s: %s\n", envVar, err)
+	}
+	keyStore, err := utils.NewKeyStore(masterKey)
+	if err != nil {
+		log.Fatalf("Loading %s: %s\n", envVar, err)
+	}
+	if !keyStore.Encrypted() && envVar == "MASTER_KEY" {
+		log.Println("No MASTER_KEY set, private keys are stored unencrypted")
+	}
+	return keyStore
+}
+
+// starts the RSA key pool, sized by KEY_POOL_SIZE (default 5, 0 disables it) with KEY_BITS bit keys (default 4096)
+func keyPoolSetUp() *utils.KeyPool {
+	size, bits := 5, utils.DefaultKeyBits
+	var err error
+	if os.Getenv("KEY_POOL_SIZE") != "" {
+		size, err = strconv.Atoi(os.Getenv("KEY_POOL_SIZE"))
+		if err != nil || size < 0 {
+			log.Fatalln("KEY_POOL_SIZE must be a non-negative number")
+		}
+	}
+	if os.Getenv("KEY_BITS") != "" {
+		bits, err = strconv.Atoi(os.Getenv("KEY_BITS"))
+		if err != nil || bits < 2048 {
+			log.Fatalln("KEY_BITS must be a number of at least 2048")
+		}
+	}
+	return utils.NewKeyPool(size, bits)
+}
+
+// re-encrypts every account's private key from the old key store to the new one in a single transaction
+// also encrypts keys stored before a master key was set, or decrypts them all if the new key store has no master key
+func rekey(db *sql.DB, oldKeys *utils.KeyStore, newKeys *utils.KeyStore) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows, err := tx.Query("SELECT name, privkey, edprivkey FROM accounts")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sealed := make(map[string][2]sql.NullString)
+	for rows.Next() {
+		var name string
+		var keys [2]sql.NullString
+		rows.Scan(&name, &keys[0], &keys[1])
+		// the Ed25519 key is sealed for a different owner so the two keys cannot be swapped
+		for i, owner := range []string{name, name + "#ed25519"} {
+			if !keys[i].Valid {
+				continue
+			}
+			plain, err := oldKeys.Open(keys[i].String, owner)
+			if err != nil {
+				log.Fatalf("Opening key of %s: %s\n", owner, err)
+			}
+			keys[i].String, err = newKeys.Seal(plain, owner)
+			if err != nil {
+				log.Fatalf("Sealing key of %s: %s\n", owner, err)
+			}
+		}
+		sealed[name] = keys
+	}
+	rows.Close()
+	for name, keys := range sealed {
+		_, err = tx.Exec("UPDATE accounts SET privkey = ?, edprivkey = ? WHERE name = ?", keys[0], keys[1], name)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Re-keyed the private keys of %d accounts\n", len(sealed))
+}
+
 func main() {
 	// set up port number
 	err := godotenv.Load()
@@ -59,12 +350,38 @@ func main() {
 		port = "3000"
 	}
 
+	// `ap-server genkey` prints a new random master key for MASTER_KEY and exits
+	if len(os.Args) > 1 && os.Args[1] == "genkey" {
+		fmt.Println(utils.GenerateMasterKey())
+		return
+	}
+
 	// set up db
 	db := dbSetUp()
 	defer db.Close()
 
+	// set up encryption of private keys at rest
+	keyStore := keyStoreSetUp("MASTER_KEY")
+
+	// `ap-server rekey` re-encrypts all private keys under NEW_MASTER_KEY and exits
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		rekey(db, keyStore, keyStoreSetUp("NEW_MASTER_KEY"))
+		return
+	}
+
 	// register server resources so packages can access them
-	app.InitApp(db, os.Getenv("DOMAIN"), os.Getenv("PORT"))
+	app.InitApp(db, os.Getenv("DOMAIN"), os.Getenv("PORT"), keyStore, keyPoolSetUp())
+
+	// set up the actor the server acts as on its own behalf
+	err = handlers.InitInstanceActor()
+	if err != nil {
+		log.Fatalln("Setting up instance actor: ", err)
+	}
+
+	// start background jobs
+	handlers.StartPollCloser()
+	handlers.StartScheduler()
+	handlers.StartWebhookDeliverer()
 
 	// set up routes
 	// main router
@@ -73,7 +390,11 @@ func main() {
 	fs := http.FileServer(http.Dir("static"))
 	r.Handle("/admin/", http.StripPrefix("/admin/", fs))
 
-	defaultCors := cors.Default().Handler
+	// the defaults, plus the Authorization header for bearer tokens
+	defaultCors := cors.New(cors.Options{
+		AllowedMethods: []string{"GET", "POST", "HEAD", "DELETE"},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization"},
+	}).Handler
 
 	// webfinger route
 	webfingerSubrouter := r.PathPrefix("/.well-known/webfinger").Subrouter()
@@ -84,8 +405,24 @@ func main() {
 	userSubrouter := r.PathPrefix("/u").Subrouter()
 	userSubrouter.Use(defaultCors)
 	userSubrouter.HandleFunc("/{name}/followers", handlers.UserFollowersHandler).Methods("GET")
+	userSubrouter.HandleFunc("/{name}/outbox", handlers.UserOutboxHandler).Methods("GET")
+	userSubrouter.HandleFunc("/{name}/outbox", handlers.PostOutboxHandler).Methods("POST")
+	userSubrouter.HandleFunc("/{name}/liked", handlers.UserLikedHandler).Methods("GET")
+	userSubrouter.HandleFunc("/{name}/collections/featured", handlers.UserFeaturedHandler).Methods("GET")
+	userSubrouter.HandleFunc("/{name}/keys/{id}", handlers.UserKeyHandler).Methods("GET")
 	userSubrouter.HandleFunc("/{name}", handlers.UserNameHandler).Methods("GET")
 
+	// object route, for the ids of the posts and activities we send
+	objectSubrouter := r.PathPrefix("/m").Subrouter()
+	objectSubrouter.Use(defaultCors)
+	objectSubrouter.HandleFunc("/{guid}", handlers.ObjectHandler).Methods("GET")
+
+	// instance actor routes
+	instanceSubrouter := r.PathPrefix("/actor").Subrouter()
+	instanceSubrouter.Use(defaultCors)
+	instanceSubrouter.HandleFunc("/outbox", handlers.InstanceOutboxHandler).Methods("GET")
+	instanceSubrouter.PathPrefix("").HandlerFunc(handlers.InstanceActorHandler).Methods("GET")
+
 	// inbox route
 	inboxSubrouter := r.PathPrefix("/api/inbox").Subrouter()
 	inboxSubrouter.Use(defaultCors)
@@ -96,6 +433,81 @@ func main() {
 	sendSubrouter.Use(defaultCors)
 	sendSubrouter.PathPrefix("").HandlerFunc(handlers.SendHandler).Methods("POST")
 
+	// boost, favourite and pin routes
+	interactSubrouter := r.PathPrefix("/api").Subrouter()
+	interactSubrouter.Use(defaultCors)
+	interactSubrouter.HandleFunc("/announce", handlers.AnnounceHandler).Methods("POST")
+	interactSubrouter.HandleFunc("/announce/undo", handlers.UndoAnnounceHandler).Methods("POST")
+	interactSubrouter.HandleFunc("/like", handlers.LikeHandler).Methods("POST")
+	interactSubrouter.HandleFunc("/like/undo", handlers.UndoLikeHandler).Methods("POST")
+	interactSubrouter.HandleFunc("/pin", handlers.PinHandler).Methods("POST")
+	interactSubrouter.HandleFunc("/unpin", handlers.UnpinHandler).Methods("POST")
+
+	// following and account migration routes
+	accountSubrouter := r.PathPrefix("/api").Subrouter()
+	accountSubrouter.Use(defaultCors)
+	accountSubrouter.HandleFunc("/follow", handlers.FollowHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/unfollow", handlers.UnfollowHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/aliases", handlers.AliasesHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/move", handlers.MoveHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/block", handlers.BlockHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/unblock", handlers.UnblockHandler).Methods("POST")
+	accountSubrouter.HandleFunc("/blocks", handlers.BlocksHandler).Methods("GET")
+
+	// scheduled posts routes
+	scheduledSubrouter := r.PathPrefix("/api/scheduled").Subrouter()
+	scheduledSubrouter.Use(defaultCors)
+	scheduledSubrouter.HandleFunc("/{id}/cancel", handlers.ScheduledCancelHandler).Methods("POST")
+	scheduledSubrouter.HandleFunc("/{id}/reschedule", handlers.ScheduledRescheduleHandler).Methods("POST")
+	scheduledSubrouter.PathPrefix("").HandlerFunc(handlers.ScheduledListHandler).Methods("GET")
+
+	// token routes
+	tokenSubrouter := r.PathPrefix("/api/tokens").Subrouter()
+	tokenSubrouter.Use(defaultCors)
+	tokenSubrouter.HandleFunc("/{id}/revoke", handlers.RevokeTokenHandler).Methods("POST")
+	tokenSubrouter.PathPrefix("").HandlerFunc(handlers.TokensHandler).Methods("GET")
+	tokenSubrouter.PathPrefix("").HandlerFunc(handlers.CreateTokenHandler).Methods("POST")
+
+	// OAuth routes, the authorize ones are visited by the user's browser
+	r.HandleFunc("/.well-known/oauth-authorization-server", handlers.OAuthMetadataHandler).Methods("GET")
+	r.HandleFunc("/oauth/authorize", handlers.OAuthAuthorizeHandler).Methods("GET")
+	r.HandleFunc("/oauth/authorize", handlers.OAuthApproveHandler).Methods("POST")
+	oauthSubrouter := r.PathPrefix("/oauth").Subrouter()
+	oauthSubrouter.Use(defaultCors)
+	oauthSubrouter.HandleFunc("/register", handlers.OAuthRegisterHandler).Methods("POST")
+	oauthSubrouter.HandleFunc("/token", handlers.OAuthTokenHandler).Methods("POST")
+	oauthSubrouter.HandleFunc("/introspect", handlers.OAuthIntrospectHandler).Methods("POST")
+	oauthSubrouter.HandleFunc("/revoke", handlers.OAuthRevokeHandler).Methods("POST")
+
+	// notifications routes
+	notificationsSubrouter := r.PathPrefix("/api/notifications").Subrouter()
+	notificationsSubrouter.Use(defaultCors)
+	notificationsSubrouter.HandleFunc("/unread", handlers.UnreadNotificationsHandler).Methods("GET")
+	notificationsSubrouter.HandleFunc("/read", handlers.ReadNotificationsHandler).Methods("POST")
+	notificationsSubrouter.PathPrefix("").HandlerFunc(handlers.NotificationsHandler).Methods("GET")
+
+	// webhook routes
+	webhookSubrouter := r.PathPrefix("/api/webhooks").Subrouter()
+	webhookSubrouter.Use(defaultCors)
+	webhookSubrouter.HandleFunc("/{id}/delete", handlers.DeleteWebhookHandler).Methods("POST")
+	webhookSubrouter.HandleFunc("/{id}/ping", handlers.PingWebhookHandler).Methods("POST")
+	webhookSubrouter.HandleFunc("/{id}/deliveries", handlers.WebhookDeliveriesHandler).Methods("GET")
+	webhookSubrouter.PathPrefix("").HandlerFunc(handlers.WebhooksHandler).Methods("GET")
+	webhookSubrouter.PathPrefix("").HandlerFunc(handlers.CreateWebhookHandler).Methods("POST")
+
+	// Mastodon client API routes
+	mastodonSubrouter := r.PathPrefix("/api/v1").Subrouter()
+	mastodonSubrouter.Use(defaultCors)
+	mastodonSubrouter.HandleFunc("/apps", handlers.MastodonAppsHandler).Methods("POST")
+	mastodonSubrouter.HandleFunc("/accounts/verify_credentials", handlers.MastodonVerifyCredentialsHandler).Methods("GET")
+	mastodonSubrouter.HandleFunc("/accounts/{id}", handlers.MastodonAccountHandler).Methods("GET")
+	mastodonSubrouter.HandleFunc("/statuses", handlers.MastodonPostStatusHandler).Methods("POST")
+	mastodonSubrouter.HandleFunc("/statuses/{id}", handlers.MastodonStatusHandler).Methods("GET")
+	mastodonSubrouter.HandleFunc("/statuses/{id}", handlers.MastodonDeleteStatusHandler).Methods("DELETE")
+	mastodonSubrouter.HandleFunc("/timelines/home", handlers.MastodonHomeTimelineHandler).Methods("GET")
+	mastodonSubrouter.HandleFunc("/notifications", handlers.MastodonNotificationsHandler).Methods("GET")
+	mastodonSubrouter.HandleFunc("/instance", handlers.MastodonInstanceHandler).Methods("GET")
+
 	// credentials cors + http authorizer subroute (/api/admin)
 	// set up http authorizer
 	credentialCors := cors.New(cors.Options{
@@ -111,6 +523,28 @@ func main() {
 	adminSubrouter.Use(credentialCors.Handler)
 	adminSubrouter.Use(middlewares.BasicAuthMiddleware)
 	adminSubrouter.HandleFunc("/create", handlers.CreateHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/rotate-key", handlers.RotateKeyHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/keypool", handlers.KeyPoolHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/domain-blocks", handlers.DomainBlocksHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/domain-blocks", handlers.DomainBlockHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/domain-blocks/remove", handlers.DomainUnblockHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/domain-blocks/export", handlers.DomainBlocksExportHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/domain-blocks/import", handlers.DomainBlocksImportHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts", handlers.AccountsHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/accounts/{name}", handlers.AccountHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/accounts/{name}/suspend", handlers.SuspendAccountHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts/{name}/unsuspend", handlers.UnsuspendAccountHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts/{name}/silence", handlers.SilenceAccountHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts/{name}/unsilence", handlers.UnsilenceAccountHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts/{name}/delete", handlers.DeleteAccountHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/accounts/{name}/reset-credentials", handlers.ResetCredentialsHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/reports", handlers.ReportsHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/reports", handlers.FileReportHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/reports/{id}", handlers.ReportHandler).Methods("GET")
+	adminSubrouter.HandleFunc("/reports/{id}/assign", handlers.AssignReportHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/reports/{id}/resolve", handlers.ResolveReportHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/reports/{id}/reopen", handlers.ReopenReportHandler).Methods("POST")
+	adminSubrouter.HandleFunc("/reports/{id}/notes", handlers.ReportNoteHandler).Methods("POST")
 
 	// catch-all route
 	r.PathPrefix("/").HandlerFunc(catchAllHandler)
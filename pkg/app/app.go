@@ -1,20 +1,27 @@
 package app
 
-import "database/sql"
+import (
+	"ap-server/pkg/utils"
+	"database/sql"
+)
 
 // define a struct and var for packages to access server resources
 type Server struct {
     DB *sql.DB
 	Domain string
 	Port string
+	Keys *utils.KeyStore // seals private keys stored in the db
+	KeyPool *utils.KeyPool // pre-generated RSA keys for new accounts
 }
 
 var App *Server
 
-func InitApp(db *sql.DB, domain string, port string) {
+func InitApp(db *sql.DB, domain string, port string, keys *utils.KeyStore, keyPool *utils.KeyPool) {
 	App = &Server {
 		DB: db,
 		Domain: domain,
 		Port: port,
+		Keys: keys,
+		KeyPool: keyPool,
 	}
 }
\ No newline at end of file
@@ -0,0 +1,183 @@
+// Package fetch dereferences remote ActivityPub objects with signed GET requests,
+// which servers running in "secure mode" (authorized fetch) require.
+package fetch
+
+import (
+	"ap-server/pkg/httpsig"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxRedirects = 3
+	maxBodySize  = 1 << 20 // 1 MiB, far more than any actor or note needs
+)
+
+// returns the key GET requests are signed with, e.g. the instance actor's
+type KeyFunc func() (httpsig.Key, error)
+
+type Client struct {
+	http *http.Client
+	key  KeyFunc
+}
+
+func NewClient(key KeyFunc) *Client {
+	c := &Client{key: key}
+	c.http = &http.Client{
+		Timeout:       10 * time.Second,
+		Transport:     PublicTransport(),
+		CheckRedirect: c.checkRedirect,
+	}
+	return c
+}
+
+// fetches an object and decodes it into v
+// the response must be ActivityStreams JSON, and the object's id must be on the host it was served from
+func (c *Client) Get(uri string, v interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
+	err = c.sign(req)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", uri, resp.Status)
+	}
+	if !isActivityStreams(resp.Header.Get("Content-Type")) {
+		return fmt.Errorf("fetching %s: unexpected content type %q", uri, resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxBodySize {
+		return fmt.Errorf("fetching %s: response is too large", uri)
+	}
+
+	// a server may only serve objects it owns, checked against the URL after redirects
+	var obj struct {
+		ID string `json:"id"`
+	}
+	err = json.Unmarshal(body, &obj)
+	if err != nil {
+		return err
+	}
+	idUrl, err := url.Parse(obj.ID)
+	if err != nil || obj.ID == "" || !strings.EqualFold(idUrl.Host, resp.Request.URL.Host) {
+		return fmt.Errorf("fetching %s: object id %q is not on %s", uri, obj.ID, resp.Request.URL.Host)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *Client) sign(req *http.Request) error {
+	key, err := c.key()
+	if err != nil {
+		return err
+	}
+	// draft-cavage over (request-target) host date is what every secure mode server accepts for GETs
+	return httpsig.Sign(req, nil, key, httpsig.Cavage)
+}
+
+// follows a few redirects, never from https to http, and signs each hop for its own target
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("too many redirects")
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return errors.New("refusing to follow a redirect from https to http")
+	}
+	req.Header.Del("Signature")
+	req.Header.Del("Signature-Input")
+	return c.sign(req)
+}
+
+// returns a transport that only connects to public addresses, so that a remote server cannot make us request
+// our own or our network's services, e.g. a cloud metadata endpoint
+// the address is checked when dialling, after DNS resolution, which covers redirects and DNS rebinding too
+// proxies from the environment are not used, as the proxy's address would be checked instead of the target's
+func PublicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   refuseNonPublic,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// address ranges that are not reachable on the public internet, beyond the ones netip can tell
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+}
+
+// a net.Dialer Control hook refusing connections to loopback, private, link-local (including the metadata
+// endpoint 169.254.169.254) and other non-public addresses
+func refuseNonPublic(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("refusing to connect to non-public address %s", addr)
+	}
+	return nil
+}
+
+// whether an address is a public unicast address
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false // also covers loopback, link-local, multicast and unspecified addresses
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func isActivityStreams(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/activity+json":
+		return true
+	case "application/ld+json":
+		return strings.Contains(params["profile"], "https://www.w3.org/ns/activitystreams")
+	}
+	return false
+}
@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// states of an account, a missing status is active
+const (
+	accountActive    = "active"
+	accountSilenced  = "silenced"  // can only post to its followers
+	accountSuspended = "suspended" // actor is gone, API key is disabled and nothing is delivered for it
+	accountDeleted   = "deleted"   // only a tombstone is left, so the name cannot be taken again
+)
+
+var errAccountSuspended = errors.New("account is suspended")
+
+func SuspendAccountHandler(w http.ResponseWriter, r *http.Request) {
+	setAccountStatus(w, mux.Vars(r)["name"], accountSuspended, accountActive, accountSilenced)
+}
+
+func UnsuspendAccountHandler(w http.ResponseWriter, r *http.Request) {
+	setAccountStatus(w, mux.Vars(r)["name"], accountActive, accountSuspended)
+}
+
+// a suspended account stays suspended, it has to be unsuspended first
+func SilenceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	setAccountStatus(w, mux.Vars(r)["name"], accountSilenced, accountActive)
+}
+
+func UnsilenceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	setAccountStatus(w, mux.Vars(r)["name"], accountActive, accountSilenced)
+}
+
+// permanently deletes an account: a Delete of the actor is sent to its followers,
+// then its keys and data are removed, leaving a tombstone
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == instanceName() { // defined in instance.go
+		http.Error(w, "The instance actor cannot be deleted", http.StatusBadRequest)
+		return
+	}
+	status, err := getAccountStatus(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if status == accountDeleted {
+		http.Error(w, "Account is already deleted", http.StatusGone)
+		return
+	}
+
+	err = sendActorDelete(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	err = deleteAccountData(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// changes the status of an account that is in one of the 'from' states, and responds
+// an account in another state, e.g. one suspended when lifting a silence, is left alone with 409 Conflict
+func setAccountStatus(w http.ResponseWriter, name string, status string, from ...string) {
+	if name == instanceName() {
+		http.Error(w, "The instance actor cannot be changed", http.StatusBadRequest)
+		return
+	}
+	current, err := getAccountStatus(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if current == accountDeleted {
+		http.Error(w, "Account is deleted", http.StatusGone)
+		return
+	}
+	// the expected state is checked in the update itself, so that concurrent changes cannot be overwritten
+	query := "UPDATE accounts SET status = ? WHERE name = ? AND COALESCE(NULLIF(status, ''), ?) IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+	args := []interface{}{status, fmt.Sprintf("%s@%s", name, app.App.Domain), accountActive}
+	for _, state := range from {
+		args = append(args, state)
+	}
+	db := app.App.DB
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		current, _ = getAccountStatus(name)
+		http.Error(w, fmt.Sprintf("Account is %s, not %s", current, strings.Join(from, " or ")), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+func getAccountStatus(name string) (string, error) {
+	db := app.App.DB
+	var status sql.NullString
+	err := db.QueryRow("SELECT status FROM accounts WHERE name = ?", fmt.Sprintf("%s@%s", name, app.App.Domain)).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+	if !status.Valid || status.String == "" {
+		return accountActive, nil
+	}
+	return status.String, nil
+}
+
+// whether the account can no longer act, i.e. it is suspended or deleted
+func isAccountSuspended(name string) bool {
+	status, err := getAccountStatus(name)
+	return err == nil && (status == accountSuspended || status == accountDeleted)
+}
+
+// responds with a Tombstone for accounts that are suspended or deleted, returns false if it did
+func checkAccountActive(w http.ResponseWriter, name string) bool {
+	if !isAccountSuspended(name) {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(Tombstone{
+		Context:    "https://www.w3.org/ns/activitystreams",
+		ID:         actorURI(name), // defined in instance.go
+		Type:       "Tombstone",
+		FormerType: "Person",
+	})
+	return false
+}
+
+// silenced accounts can only post to their followers
+func effectiveVisibility(name string, visibility string) string {
+	status, _ := getAccountStatus(name)
+	if status == accountSilenced {
+		return visibilityFollowers // defined in send.go
+	}
+	return visibility
+}
+
+// sends a Delete of the account's actor to the inbox of every follower
+// the key is loaded before anything is sent, so the deliveries still go out once it is destroyed
+func sendActorDelete(name string) error {
+	key, err := getHTTPSigKey(name) // defined in keys.go
+	if err != nil {
+		return err
+	}
+	followers, err := loadFollowers(name) // defined in user.go
+	if err != nil {
+		return err
+	}
+	deleteJSONStr, _ := json.Marshal(getActorDeleteObj(createGuid(), name))
+	deleteJSONStr = addIntegrityProof(name, deleteJSONStr) // defined in keys.go
+	for _, follower := range followers {
+		inbox := follower + "/inbox"
+		inboxUrl, err := url.Parse(inbox)
+		if err != nil || isDomainBlocked(inboxUrl.Hostname()) { // defined in domainblock.go
+			continue
+		}
+		go sendToHTTP(inbox, inboxUrl.Hostname(), deleteJSONStr, key, name) // defined in inbox.go
+	}
+	return nil
+}
+
+// removes everything stored for an account, keeping only its name and status as a tombstone
+func deleteAccountData(name string) error {
+	db := app.App.DB
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE accounts SET status = ?, deleted_at = ?, privkey = NULL, pubkey = NULL, edprivkey = NULL, edpubkey = NULL, apikey = NULL, apikey_hash = NULL, actor = NULL, webfinger = NULL, followers = NULL, messages = NULL WHERE name = ?",
+		accountDeleted, time.Now().UTC().Format(time.RFC3339), fmt.Sprintf("%s@%s", name, app.App.Domain))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM poll_votes WHERE poll IN (SELECT guid FROM polls WHERE account = ?)", name)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"messages", "polls", "pinned", "following", "keys", "scheduled_posts", "blocks", "tokens", "notifications", "webhooks", "webhook_deliveries"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE account = ?", table), name)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err == nil {
+		log.Printf("Deleted account %s", name)
+	}
+	return err
+}
+
+func getActorDeleteObj(guid string, name string) Activity {
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    "Delete",
+		Actor:   actorURI(name),
+		To:      []string{"https://www.w3.org/ns/activitystreams#Public"},
+		Object:  actorURI(name),
+	}
+}
+
+type Tombstone struct {
+	Context    string `json:"@context"`
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	FormerType string `json:"formerType"`
+}
+
+// lists the accounts, a page at a time, with 'q' matching the start of the name and 'status' filtering on it
+// takes 'page' (from 1) and 'limit' (at most 100)
+func AccountsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	// the instance actor is not an account that can be managed
+	where := "WHERE name LIKE ? ESCAPE '\\' AND name != ?"
+	escape := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	like := escape.Replace(query.Get("q")) + "%@" + escape.Replace(app.App.Domain)
+	args := []interface{}{like, fmt.Sprintf("%s@%s", instanceName(), app.App.Domain)}
+	switch status := query.Get("status"); status {
+	case "":
+	case accountActive:
+		where += " AND (status IS NULL OR status = '' OR status = ?)"
+		args = append(args, status)
+	default:
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	db := app.App.DB
+	var total int
+	err = db.QueryRow("SELECT COUNT(*) FROM accounts "+where, args...).Scan(&total)
+	if err != nil {
+		handleErr(err, w, "accounts")
+		return
+	}
+	rows, err := db.Query("SELECT name FROM accounts "+where+" ORDER BY name COLLATE NOCASE LIMIT ? OFFSET ?", append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		handleErr(err, w, "accounts")
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var dbName string
+		rows.Scan(&dbName)
+		names = append(names, strings.TrimSuffix(dbName, "@"+app.App.Domain))
+	}
+	rows.Close()
+
+	accounts := make([]AccountSummary, 0, len(names))
+	for _, name := range names {
+		account, err := loadAccountSummary(name)
+		if err != nil {
+			handleErr(err, w, name)
+			return
+		}
+		accounts = append(accounts, account)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AccountList{Accounts: accounts, Total: total, Page: page, Limit: limit})
+}
+
+// shows an account with its followers counted by domain and its most recent deliveries
+func AccountHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == instanceName() {
+		handleErr(sql.ErrNoRows, w, name)
+		return
+	}
+	summary, err := loadAccountSummary(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	account := AccountDetail{AccountSummary: summary, FollowersByDomain: map[string]int{}}
+
+	db := app.App.DB
+	var deletedAt sql.NullString
+	err = db.QueryRow("SELECT deleted_at FROM accounts WHERE name = ?", fmt.Sprintf("%s@%s", name, app.App.Domain)).Scan(&deletedAt)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	account.DeletedAt = deletedAt.String
+	err = db.QueryRow("SELECT COUNT(*) FROM following WHERE account = ? AND accepted = 1", name).Scan(&account.FollowingCount)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM blocks WHERE account = ?", name).Scan(&account.BlocksCount)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	followers, err := loadFollowers(name) // defined in user.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	for _, follower := range followers {
+		account.FollowersByDomain[uriHost(follower)]++ // defined in domainblock.go
+	}
+	account.RecentDeliveries, err = loadDeliveries(name, 50) // defined in delivery.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(account)
+}
+
+// loads what the account listing shows of an account, posts being the Notes and Questions it published
+func loadAccountSummary(name string) (AccountSummary, error) {
+	account := AccountSummary{Name: name, Actor: actorURI(name)}
+	status, err := getAccountStatus(name)
+	if err != nil {
+		return account, err
+	}
+	account.Status = status
+
+	db := app.App.DB
+	var createdAt sql.NullString
+	var followersJSONStr []byte
+	err = db.QueryRow("SELECT created_at, followers FROM accounts WHERE name = ?", fmt.Sprintf("%s@%s", name, app.App.Domain)).Scan(&createdAt, &followersJSONStr)
+	if err != nil {
+		return account, err
+	}
+	account.CreatedAt = createdAt.String
+	var followers []string
+	json.Unmarshal(followersJSONStr, &followers)
+	account.FollowersCount = len(followers)
+
+	var lastPostAt sql.NullString
+	err = db.QueryRow("SELECT COUNT(*), MAX(published) FROM messages WHERE account = ? AND type IN ('Note', 'Question')", name).Scan(&account.PostsCount, &lastPostAt)
+	account.LastPostAt = lastPostAt.String
+	return account, err
+}
+
+type AccountSummary struct {
+	Name           string `json:"name"`
+	Actor          string `json:"actor"`
+	Status         string `json:"status"`
+	CreatedAt      string `json:"created_at,omitempty"`
+	FollowersCount int    `json:"followers_count"`
+	PostsCount     int    `json:"posts_count"`
+	LastPostAt     string `json:"last_post_at,omitempty"`
+}
+
+type AccountList struct {
+	Accounts []AccountSummary `json:"accounts"`
+	Total    int              `json:"total"`
+	Page     int              `json:"page"`
+	Limit    int              `json:"limit"`
+}
+
+type AccountDetail struct {
+	AccountSummary
+	DeletedAt         string         `json:"deleted_at,omitempty"`
+	FollowingCount    int            `json:"following_count"`
+	BlocksCount       int            `json:"blocks_count"`
+	FollowersByDomain map[string]int `json:"followers_by_domain"`
+	RecentDeliveries  []Delivery     `json:"recent_deliveries"`
+}
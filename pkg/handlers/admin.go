@@ -4,11 +4,21 @@ import (
 	"ap-server/pkg/app"
 	"ap-server/pkg/utils"
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/exp/slices"
 )
 
 func CreateHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,21 +28,65 @@ func CreateHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
     name := r.FormValue("account")
+	err := validateUsername(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// names are unique regardless of case, and deleted accounts keep theirs
+	taken, err := isUsernameTaken(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if taken {
+		http.Error(w, fmt.Sprintf("Account %s already exists", name), http.StatusConflict)
+		return
+	}
 
 	// create keypair
-	privKey, pubKey := utils.GetEncodedKeys()
+	privKey, pubKey := app.App.KeyPool.Get()
 	
 	domain := app.App.Domain
 	db := app.App.DB
 	// create actor, webfinger, and api key fields for account
-	actorJSONStr, _ := json.Marshal(getActorObj(name, domain, pubKey))
+	actorObj := getActorObj(name, domain, pubKey)
+
+	// optionally add an Ed25519 key, published as a Multikey (FEP-521a) next to the RSA key
+	var edPrivKey, edPubKey sql.NullString
+	if r.FormValue("ed25519") == "true" || os.Getenv("ED25519_KEYS") == "true" {
+		edPrivKey.String, edPubKey.String = utils.GetEd25519Keys()
+		edPrivKey.Valid, edPubKey.Valid = true, true
+		actorObj.AssertionMethod = []Multikey{getMultikeyObj(name, domain, edPubKey.String)}
+	}
+	actorJSONStr, _ := json.Marshal(actorObj)
 	webfingerJSONStr, _ := json.Marshal(getWebFingerObj(name, domain))
 	apiKey := createAPIKey()
 
-	// insert to db
-	stmt, _ := db.Prepare("INSERT or REPLACE into accounts(name, actor, apikey, pubkey, privkey, webfinger) values(?, ?, ?, ?, ?, ?)")
+	// insert to db, with the private key encrypted if a master key is configured
 	dbName := fmt.Sprintf("%s@%s", name, domain)
-	_, err := stmt.Exec(dbName, actorJSONStr, apiKey, pubKey, privKey, webfingerJSONStr)
+	sealedPrivKey, err := app.App.Keys.Seal(privKey, dbName)
+	if err != nil {
+		http.Error(w, "Error creating account", http.StatusInternalServerError)
+		return
+	}
+	if edPrivKey.Valid {
+		edPrivKey.String, err = app.App.Keys.Seal(edPrivKey.String, dbName+"#ed25519")
+		if err != nil {
+			http.Error(w, "Error creating account", http.StatusInternalServerError)
+			return
+		}
+	}
+	// only a hash of the API key is kept, like for tokens
+	stmt, _ := db.Prepare("INSERT into accounts(name, actor, apikey_hash, pubkey, privkey, webfinger, edpubkey, edprivkey, created_at) values(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	_, err = stmt.Exec(dbName, actorJSONStr, hashToken(apiKey), pubKey, sealedPrivKey, webfingerJSONStr, edPubKey, edPrivKey, time.Now().UTC().Format(time.RFC3339))
+	if isUniqueViolation(err) { // created by another request in the meantime
+		http.Error(w, fmt.Sprintf("Account %s already exists", name), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = recordKey(name, fmt.Sprintf("https://%s/u/%s#main-key", domain, name), pubKey) // defined in keys.go
+	}
 
 	// response
 	if err != nil {
@@ -44,6 +98,82 @@ func CreateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// replaces the API key of an account and returns the new one, the old key and the account's tokens stop working right away
+// the signing keys are left alone, they are replaced with /api/admin/rotate-key
+func ResetCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	status, err := getAccountStatus(name) // defined in account.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if status == accountDeleted || name == instanceName() {
+		http.Error(w, "Account has no credentials", http.StatusBadRequest)
+		return
+	}
+	// the account's tokens and pending OAuth codes are revoked with the old key, as they may have leaked with it
+	apiKey := createAPIKey()
+	db := app.App.DB
+	tx, err := db.Begin()
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE accounts SET apikey_hash = ? WHERE name = ?", hashToken(apiKey), fmt.Sprintf("%s@%s", name, app.App.Domain)) // defined in token.go
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tokens WHERE account = ?", name)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM oauth_codes WHERE account = ?", name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"apikey": apiKey, "msg": "ok"})
+}
+
+// checks that a username is 1 to 30 letters, digits or underscores and not reserved, as Mastodon does
+func validateUsername(name string) error {
+	if !usernamePattern.MatchString(name) {
+		return errors.New("account names must be 1 to 30 letters, digits or underscores")
+	}
+	if slices.Contains(reservedUsernames, strings.ToLower(name)) {
+		return fmt.Errorf("the account name %s is reserved", name)
+	}
+	return nil
+}
+
+func isUsernameTaken(name string) (bool, error) {
+	db := app.App.DB
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM accounts WHERE name = ? COLLATE NOCASE", fmt.Sprintf("%s@%s", name, app.App.Domain)).Scan(&count)
+	return count > 0, err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
+// reports the depth of the RSA key pool and how long keys take to generate
+func KeyPoolHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(app.App.KeyPool.Stats())
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,30}$`)
+
+// names that would be confused with the server's own routes or staff
+var reservedUsernames = []string{"admin", "administrator", "actor", "inbox", "outbox", "api", "root", "instance", "relay", "support", "abuse", "postmaster", "webmaster", "security", "moderator"}
+
 // creates a random 32 character HEX string
 func createAPIKey() string {
 	b := make([]byte, 16) // 16 bytes, 32 HEX chars
@@ -58,9 +188,16 @@ func createAPIKey() string {
 func getActorObj(name string, domain string, pubKey string) Actor {
     idURI := fmt.Sprintf("https://%s/u/%s", domain, name)
     return Actor{
-        Context: []string{
+        Context: []interface{}{
             "https://www.w3.org/ns/activitystreams",
             "https://w3id.org/security/v1",
+            "https://w3id.org/security/data-integrity/v1",
+            map[string]interface{}{
+                "toot":        "http://joinmastodon.org/ns#",
+                "featured":    map[string]string{"@id": "toot:featured", "@type": "@id"},
+                "alsoKnownAs": map[string]string{"@id": "as:alsoKnownAs", "@type": "@id"},
+                "movedTo":     map[string]string{"@id": "as:movedTo", "@type": "@id"},
+            },
         },
         ID:                idURI,
         Type:              "Person",
@@ -68,6 +205,8 @@ func getActorObj(name string, domain string, pubKey string) Actor {
         Inbox:             fmt.Sprintf("https://%s/api/inbox", domain),
         Outbox:            idURI + "/outbox",
         Followers:         idURI + "/followers",
+        Liked:             idURI + "/liked",
+        Featured:          idURI + "/collections/featured",
         PublicKey: PublicKey{
             ID:           idURI + "#main-key",
             Owner:        idURI,
@@ -76,6 +215,16 @@ func getActorObj(name string, domain string, pubKey string) Actor {
     }
 }
 
+func getMultikeyObj(name string, domain string, pubKeyMultibase string) Multikey {
+    idURI := fmt.Sprintf("https://%s/u/%s", domain, name)
+    return Multikey{
+        ID:                 idURI + "#ed25519-key",
+        Type:               "Multikey",
+        Controller:         idURI,
+        PublicKeyMultibase: pubKeyMultibase,
+    }
+}
+
 func getWebFingerObj(name string, domain string) Webfinger {
     return Webfinger{
         Subject: fmt.Sprintf("acct:%s@%s", name, domain),
@@ -96,14 +245,26 @@ type PublicKey struct {
 }
 
 type Actor struct {
-    Context           []string `json:"@context"`
+    Context           []interface{} `json:"@context"`
     ID                string   `json:"id"`
     Type              string   `json:"type"`
     PreferredUsername string   `json:"preferredUsername"`
     Inbox             string   `json:"inbox"`
     Outbox            string   `json:"outbox"`
     Followers         string   `json:"followers"`
+    Liked             string   `json:"liked"`
+    Featured          string   `json:"featured"`
+    AlsoKnownAs       []string `json:"alsoKnownAs,omitempty"`
+    MovedTo           string   `json:"movedTo,omitempty"`
     PublicKey         PublicKey `json:"publicKey"`
+    AssertionMethod   []Multikey `json:"assertionMethod,omitempty"`
+}
+
+type Multikey struct {
+    ID                 string `json:"id"`
+    Type               string `json:"type"`
+    Controller         string `json:"controller"`
+    PublicKeyMultibase string `json:"publicKeyMultibase"`
 }
 
 type Link struct {
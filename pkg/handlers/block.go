@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	errAlreadyBlocked = errors.New("actor is already blocked")
+	errInvalidTarget  = errors.New("target is not an actor URI")
+)
+
+// blocks a remote actor for the account: they stop being a follower, their Follows are rejected and nothing is delivered to them
+func BlockHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeFollow) // defined in send.go
+	if !ok {
+		return
+	}
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "Bad request. Please send the URI of the actor to block as 'target'.", http.StatusBadRequest)
+		return
+	}
+	_, err := sendBlock(name, target)
+	if err == errInvalidTarget {
+		http.Error(w, "Bad request. Please send the URI of the actor to block as 'target'.", http.StatusBadRequest)
+		return
+	}
+	if err == errAlreadyBlocked {
+		http.Error(w, "Actor is already blocked", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// lifts a block and sends an Undo of the Block to the actor
+func UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeFollow) // defined in send.go
+	if !ok {
+		return
+	}
+	target := r.FormValue("target")
+
+	_, err := sendUnblock(name, target)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, target)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// lists the actors the account blocks
+func BlocksHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeRead) // defined in send.go
+	if !ok {
+		return
+	}
+	blocked, err := loadBlocked(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blocked)
+}
+
+// blocks the actor and sends it a Block: it stops being a follower and our follow of it, if any, ends
+// the block holds even if the actor cannot be fetched, only the Block is then not delivered
+func sendBlock(name string, target string) (Activity, error) {
+	if uriHost(target) == "" { // defined in domainblock.go
+		return Activity{}, errInvalidTarget
+	}
+	blockObj := getBlockObj(fmt.Sprintf("https://%s/m/%s", app.App.Domain, createGuid()), name, target)
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO blocks(account, target, block_id, created_at) VALUES(?, ?, ?, ?)")
+	_, err := stmt.Exec(name, target, blockObj.ID, time.Now().UTC().Format(time.RFC3339))
+	if isUniqueViolation(err) { // defined in admin.go
+		return Activity{}, errAlreadyBlocked
+	}
+	if err != nil {
+		return Activity{}, err
+	}
+
+	err = removeFollower(name, target)
+	if err != nil {
+		return Activity{}, err
+	}
+	// blocking also ends our follow of them, if any
+	_, err = sendUnfollow(name, target) // defined in follow.go
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Unfollowing blocked actor: ", err)
+	}
+
+	targetActor, err := fetchActor(target) // defined in fetch.go
+	if err != nil {
+		log.Println("Fetching blocked actor: ", err)
+		return blockObj, nil
+	}
+	blockJSONStr, _ := json.Marshal(blockObj)
+	deliverToInboxes([]string{targetActor.Inbox}, blockJSONStr, name) // defined in send.go
+	return blockObj, nil
+}
+
+// lifts a block and sends an Undo of the Block to the actor, the block is lifted even if the actor is gone
+func sendUnblock(name string, target string) (Activity, error) {
+	db := app.App.DB
+	var blockId string
+	err := db.QueryRow("SELECT block_id FROM blocks WHERE account = ? AND target = ?", name, target).Scan(&blockId)
+	if err != nil {
+		return Activity{}, err
+	}
+	_, err = db.Exec("DELETE FROM blocks WHERE account = ? AND target = ?", name, target)
+	if err != nil {
+		return Activity{}, err
+	}
+
+	undoObj := getUndoObj(createGuid(), name, getBlockObj(blockId, name, target)) // defined in interact.go
+	targetActor, err := fetchActor(target)
+	if err != nil {
+		log.Println("Fetching unblocked actor: ", err)
+		return undoObj, nil
+	}
+	undoJSONStr, _ := json.Marshal(undoObj)
+	deliverToInboxes([]string{targetActor.Inbox}, undoJSONStr, name)
+	return undoObj, nil
+}
+
+func loadBlocked(name string) ([]string, error) {
+	db := app.App.DB
+	rows, err := db.Query("SELECT target FROM blocks WHERE account = ? ORDER BY created_at", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocked := make([]string, 0)
+	for rows.Next() {
+		var target string
+		rows.Scan(&target)
+		blocked = append(blocked, target)
+	}
+	return blocked, nil
+}
+
+func isBlocked(name string, actor string) bool {
+	db := app.App.DB
+	var target string
+	err := db.QueryRow("SELECT target FROM blocks WHERE account = ? AND target = ?", name, actor).Scan(&target)
+	return err == nil
+}
+
+// leaves out the actors the account blocks
+func withoutBlocked(name string, actors []string) []string {
+	blocked, err := loadBlocked(name)
+	if err != nil {
+		log.Println("Getting blocks from db: ", err)
+		return actors
+	}
+	allowed := make([]string, 0, len(actors))
+	for _, actor := range actors {
+		if !slices.Contains(blocked, actor) {
+			allowed = append(allowed, actor)
+		}
+	}
+	return allowed
+}
+
+// removes an actor from the account's followers, if it is one
+func removeFollower(name string, actor string) error {
+	followers, err := loadFollowers(name) // defined in user.go
+	if err != nil {
+		return err
+	}
+	i := slices.Index(followers, actor)
+	if i == -1 {
+		return nil
+	}
+	followers = slices.Delete(followers, i, i+1)
+	followersJSONStr, _ := json.Marshal(followers)
+	db := app.App.DB
+	_, err = db.Exec("UPDATE accounts SET followers = ? WHERE name = ?", followersJSONStr, fmt.Sprintf("%s@%s", name, app.App.Domain))
+	return err
+}
+
+func getBlockObj(id string, name string, target string) Activity {
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      id,
+		Type:    "Block",
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		To:      []string{target},
+		Object:  target,
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// how many deliveries are kept per account, older ones are dropped as new ones are recorded
+const deliveriesKept = 500
+
+// records the outcome of sending an activity to an inbox, a status code of 0 means no response was received
+func recordDelivery(name string, inbox string, msgJSONStr []byte, statusCode int, format string, deliveryErr error) {
+	var activity struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(msgJSONStr, &activity)
+	var errStr sql.NullString
+	if deliveryErr != nil {
+		errStr = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO deliveries(account, inbox, activity_id, activity_type, status_code, signature_format, error, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	_, err := stmt.Exec(name, inbox, activity.ID, activity.Type, statusCode, format, errStr, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Recording delivery: ", err)
+		return
+	}
+	_, err = db.Exec("DELETE FROM deliveries WHERE account = ? AND id <= (SELECT id FROM deliveries WHERE account = ? ORDER BY id DESC LIMIT 1 OFFSET ?)", name, name, deliveriesKept)
+	if err != nil {
+		log.Println("Pruning deliveries: ", err)
+	}
+}
+
+// returns the most recent deliveries of an account, newest first
+func loadDeliveries(name string, limit int) ([]Delivery, error) {
+	db := app.App.DB
+	rows, err := db.Query("SELECT inbox, activity_id, activity_type, status_code, signature_format, error, created_at FROM deliveries WHERE account = ? ORDER BY id DESC LIMIT ?", name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]Delivery, 0)
+	for rows.Next() {
+		var delivery Delivery
+		var errStr sql.NullString
+		rows.Scan(&delivery.Inbox, &delivery.ActivityID, &delivery.ActivityType, &delivery.StatusCode, &delivery.SignatureFormat, &errStr, &delivery.CreatedAt)
+		delivery.Error = errStr.String
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+type Delivery struct {
+	Inbox           string `json:"inbox"`
+	ActivityID      string `json:"activity_id"`
+	ActivityType    string `json:"activity_type"`
+	StatusCode      int    `json:"status_code"`
+	SignatureFormat string `json:"signature_format,omitempty"`
+	Error           string `json:"error,omitempty"`
+	CreatedAt       string `json:"created_at"`
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// severities of a domain block, named as in Mastodon's blocklist CSVs
+const (
+	severityNoop    = "noop"    // nothing but the report flag
+	severitySilence = "silence" // their follows are rejected and their followers are left out of our followers collections
+	severitySuspend = "suspend" // everything from them is dropped and nothing is sent to them
+)
+
+// header of the CSV format Mastodon imports and exports domain blocks in
+var domainBlockCSVHeader = []string{"#domain", "#severity", "#reject_media", "#reject_reports", "#public_comment", "#obfuscate"}
+
+// lists all domain blocks
+func DomainBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	blocks, err := loadDomainBlocks()
+	if err != nil {
+		handleErr(err, w, "domain blocks")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// adds a domain block, or changes the existing block of the domain
+func DomainBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return
+	}
+	block := DomainBlock{
+		Domain:         r.FormValue("domain"),
+		Severity:       r.FormValue("severity"),
+		RejectMedia:    r.FormValue("reject_media") == "true",
+		RejectReports:  r.FormValue("reject_reports") == "true",
+		PublicComment:  r.FormValue("public_comment"),
+		PrivateComment: r.FormValue("private_comment"),
+		Obfuscate:      r.FormValue("obfuscate") == "true",
+	}
+	if block.Severity == "" {
+		block.Severity = severitySuspend
+	}
+	err := saveDomainBlocks([]DomainBlock{block})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// lifts the block of a domain
+func DomainUnblockHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return
+	}
+	domain := normalizeDomain(r.FormValue("domain"))
+	db := app.App.DB
+	res, err := db.Exec("DELETE FROM domain_blocks WHERE domain = ?", domain)
+	if err != nil {
+		handleErr(err, w, domain)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, fmt.Sprintf("No record found for %s", domain), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// exports all domain blocks as a Mastodon blocklist CSV
+func DomainBlocksExportHandler(w http.ResponseWriter, r *http.Request) {
+	blocks, err := loadDomainBlocks()
+	if err != nil {
+		handleErr(err, w, "domain blocks")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="domain_blocks.csv"`)
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(domainBlockCSVHeader)
+	for _, block := range blocks {
+		csvWriter.Write([]string{
+			block.Domain,
+			block.Severity,
+			strconv.FormatBool(block.RejectMedia),
+			strconv.FormatBool(block.RejectReports),
+			block.PublicComment,
+			strconv.FormatBool(block.Obfuscate),
+		})
+	}
+	csvWriter.Flush()
+}
+
+// imports a Mastodon blocklist CSV, sent as the "file" of a multipart form or as the request body
+// a list of bare domains (without a header) is also accepted, each is then suspended
+// blocks already on the list are replaced by the imported ones
+func DomainBlocksImportHandler(w http.ResponseWriter, r *http.Request) {
+	var csvReader io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error reading the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		csvReader = file
+	}
+	blocks, err := parseDomainBlocksCSV(csvReader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = saveDomainBlocks(blocks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": len(blocks), "msg": "ok"})
+}
+
+// parses a blocklist CSV by its header, so columns may come in any order and unknown ones are skipped
+func parseDomainBlocksCSV(reader io.Reader) ([]DomainBlock, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("the blocklist is empty")
+	}
+
+	columns := map[string]int{"domain": 0}
+	if strings.HasPrefix(records[0][0], "#") || strings.EqualFold(records[0][0], "domain") {
+		columns = map[string]int{}
+		for i, column := range records[0] {
+			columns[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(column), "#"))] = i
+		}
+		records = records[1:]
+		if _, ok := columns["domain"]; !ok {
+			return nil, errors.New("the blocklist has no domain column")
+		}
+	}
+	field := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	blocks := make([]DomainBlock, 0, len(records))
+	for _, record := range records {
+		block := DomainBlock{
+			Domain:        field(record, "domain"),
+			Severity:      field(record, "severity"),
+			RejectMedia:   field(record, "reject_media") == "true",
+			RejectReports: field(record, "reject_reports") == "true",
+			PublicComment: field(record, "public_comment"),
+			Obfuscate:     field(record, "obfuscate") == "true",
+		}
+		if block.Domain == "" {
+			continue
+		}
+		if block.Severity == "" {
+			block.Severity = severitySuspend
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// checks all the blocks before saving any, then saves them together so a list is never half imported
+func saveDomainBlocks(blocks []DomainBlock) error {
+	for i := range blocks {
+		blocks[i].Domain = normalizeDomain(blocks[i].Domain)
+		if blocks[i].Domain == "" || strings.ContainsAny(blocks[i].Domain, "/@ ") {
+			return errors.New("domain must be a host name, such as example.com")
+		}
+		if blocks[i].Severity != severityNoop && blocks[i].Severity != severitySilence && blocks[i].Severity != severitySuspend {
+			return fmt.Errorf("severity of %s must be noop, silence or suspend", blocks[i].Domain)
+		}
+	}
+	db := app.App.DB
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, block := range blocks {
+		_, err = tx.Exec("INSERT OR REPLACE INTO domain_blocks(domain, severity, reject_media, reject_reports, public_comment, private_comment, obfuscate, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+			block.Domain, block.Severity, block.RejectMedia, block.RejectReports, block.PublicComment, block.PrivateComment, block.Obfuscate, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func loadDomainBlocks() ([]DomainBlock, error) {
+	db := app.App.DB
+	rows, err := db.Query("SELECT domain, severity, COALESCE(reject_media, 0), reject_reports, public_comment, private_comment, obfuscate, created_at FROM domain_blocks ORDER BY domain")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := make([]DomainBlock, 0)
+	for rows.Next() {
+		var block DomainBlock
+		rows.Scan(&block.Domain, &block.Severity, &block.RejectMedia, &block.RejectReports, &block.PublicComment, &block.PrivateComment, &block.Obfuscate, &block.CreatedAt)
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// returns the block that applies to a host, which is the block of the host itself or of the closest parent domain
+func getDomainBlock(host string) (DomainBlock, bool) {
+	host = normalizeDomain(host)
+	if host == "" {
+		return DomainBlock{}, false
+	}
+	db := app.App.DB
+	var block DomainBlock
+	err := db.QueryRow("SELECT domain, severity, reject_reports FROM domain_blocks WHERE domain = ? OR substr(?, -length(domain) - 1) = '.' || domain ORDER BY length(domain) DESC LIMIT 1", host, host).
+		Scan(&block.Domain, &block.Severity, &block.RejectReports)
+	if err != nil {
+		return DomainBlock{}, false
+	}
+	return block, true
+}
+
+// whether a host is suspended, nothing is accepted from or sent to it
+func isDomainBlocked(host string) bool {
+	block, ok := getDomainBlock(host)
+	return ok && block.Severity == severitySuspend
+}
+
+// whether a host is silenced or suspended
+func isDomainLimited(host string) bool {
+	block, ok := getDomainBlock(host)
+	return ok && block.Severity != severityNoop
+}
+
+// returns the host of an actor or inbox URI
+func uriHost(uri string) string {
+	uriUrl, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return uriUrl.Hostname()
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+type DomainBlock struct {
+	Domain         string `json:"domain"`
+	Severity       string `json:"severity"`
+	RejectMedia    bool   `json:"reject_media"` // kept for blocklist exports, as no remote media is stored
+	RejectReports  bool   `json:"reject_reports"`
+	PublicComment  string `json:"public_comment"`
+	PrivateComment string `json:"private_comment"`
+	Obfuscate      bool   `json:"obfuscate"`
+	CreatedAt      string `json:"created_at,omitempty"`
+}
+
+var errDomainBlocked = errors.New("domain is blocked")
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"ap-server/pkg/fetch"
+	"encoding/json"
+	"fmt"
+)
+
+// signs its GETs with the instance actor's key, so servers in secure mode answer them too
+var fetchClient = fetch.NewClient(getInstanceHTTPSigKey) // defined in instance.go
+
+// dereferences an ActivityPub object or actor and decodes its JSON into v
+// suspended domains are never contacted
+func fetchJSON(uri string, v interface{}) error {
+	if isDomainBlocked(uriHost(uri)) { // defined in domainblock.go
+		return errDomainBlocked
+	}
+	return fetchClient.Get(uri, v)
+}
+
+// fetches a remote actor, which we need for its inbox
+func fetchActor(uri string) (RemoteActor, error) {
+	var actor RemoteActor
+	err := fetchJSON(uri, &actor)
+	if err == nil && actor.Inbox == "" {
+		err = fmt.Errorf("actor %s has no inbox", uri)
+	}
+	return actor, err
+}
+
+// returns the id of a JSON-LD reference, which can be a URI, an object with an id, or a list of either
+func referenceID(raw json.RawMessage) string {
+	var id string
+	if json.Unmarshal(raw, &id) == nil {
+		return id
+	}
+	var obj struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(raw, &obj) == nil {
+		return obj.ID
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil && len(list) > 0 {
+		return referenceID(list[0])
+	}
+	return ""
+}
+
+// returns the ids of all the references in a JSON-LD value, which can be a single reference or a list
+func referenceIDs(raw json.RawMessage) []string {
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		list = []json.RawMessage{raw}
+	}
+	ids := make([]string, 0, len(list))
+	for _, item := range list {
+		if id := referenceID(item); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+type RemoteObject struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	AttributedTo json.RawMessage `json:"attributedTo"`
+	Actor        json.RawMessage `json:"actor"`
+}
+
+type RemoteActor struct {
+	ID                string   `json:"id"`
+	Type              string   `json:"type"`
+	PreferredUsername string   `json:"preferredUsername"`
+	Inbox             string   `json:"inbox"`
+	AlsoKnownAs       []string `json:"alsoKnownAs"`
+	Endpoints         struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+}
+
+// returns the author of a remote object
+func (o RemoteObject) author() string {
+	if author := referenceID(o.AttributedTo); author != "" {
+		return author
+	}
+	return referenceID(o.Actor)
+}
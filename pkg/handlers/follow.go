@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// follows a remote actor on behalf of the account
+func FollowHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeFollow) // defined in send.go
+	if !ok {
+		return
+	}
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "Bad request. Please send the URI of the actor to follow as 'target'.", http.StatusBadRequest)
+		return
+	}
+
+	_, err := sendFollow(name, target)
+	if err != nil {
+		log.Println("Sending follow: ", err)
+		http.Error(w, "Could not follow actor", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+func UnfollowHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeFollow) // defined in send.go
+	if !ok {
+		return
+	}
+	target := r.FormValue("target")
+
+	_, err := sendUnfollow(name, target)
+	if err != nil {
+		handleErr(err, w, target)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// sends a Follow to the target, which stays pending in the following table until its Accept arrives
+func sendFollow(name string, target string) (FollowActivity, error) {
+	targetActor, err := fetchActor(target) // defined in fetch.go
+	if err != nil {
+		return FollowActivity{}, err
+	}
+	guid := createGuid()
+	followObj := getFollowObj(fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid), name, targetActor.ID)
+	followJSONStr, _ := json.Marshal(followObj)
+
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT OR REPLACE INTO following(account, target, follow_id, accepted) VALUES(?, ?, ?, 0)")
+	_, err = stmt.Exec(name, targetActor.ID, followObj.Id)
+	if err != nil {
+		return FollowActivity{}, err
+	}
+	deliverToInboxes([]string{targetActor.Inbox}, followJSONStr, name) // defined in send.go
+	return followObj, nil
+}
+
+// sends an Undo of the account's Follow to the target and forgets it
+func sendUnfollow(name string, target string) (Activity, error) {
+	db := app.App.DB
+	var followId string
+	err := db.QueryRow("SELECT follow_id FROM following WHERE account = ? AND target = ?", name, target).Scan(&followId)
+	if err != nil {
+		return Activity{}, err
+	}
+	_, err = db.Exec("DELETE FROM following WHERE account = ? AND target = ?", name, target)
+	if err != nil {
+		return Activity{}, err
+	}
+
+	targetActor, err := fetchActor(target)
+	if err != nil {
+		return Activity{}, err
+	}
+	undoObj := getUndoObj(createGuid(), name, getFollowObj(followId, name, target)) // defined in interact.go
+	undoJSONStr, _ := json.Marshal(undoObj)
+	deliverToInboxes([]string{targetActor.Inbox}, undoJSONStr, name)
+	return undoObj, nil
+}
+
+// marks one of our Follows as accepted
+func handleAccept(activity InboxActivity) {
+	followId := referenceID(activity.Object) // defined in fetch.go
+	db := app.App.DB
+	_, err := db.Exec("UPDATE following SET accepted = 1 WHERE follow_id = ? AND target = ?", followId, activity.Actor)
+	if err != nil {
+		log.Println("Updating following in db: ", err)
+	}
+}
+
+// forgets one of our Follows that was rejected
+func handleReject(activity InboxActivity) {
+	followId := referenceID(activity.Object)
+	db := app.App.DB
+	_, err := db.Exec("DELETE FROM following WHERE follow_id = ? AND target = ?", followId, activity.Actor)
+	if err != nil {
+		log.Println("Updating following in db: ", err)
+	}
+}
+
+func getFollowObj(id string, name string, target string) FollowActivity {
+	return FollowActivity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		Id:      id,
+		Type:    "Follow",
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		Object:  target,
+	}
+}
@@ -2,13 +2,11 @@ package handlers
 
 import (
 	"ap-server/pkg/app"
+	"ap-server/pkg/httpsig"
 	"bytes"
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
@@ -24,19 +22,69 @@ import (
 	"golang.org/x/exp/slices"
 )
 
-// note: currently only handles Follow acvitivies!
+// note: currently only handles Follow, Undo (of follows), Create (poll votes and mentions), Like/Announce (of our posts), Accept/Reject (of our follows), Move and Flag activities!
 func InboxHandler(w http.ResponseWriter, r *http.Request) {
+	// parse the activity in request, keeping the raw body for type-specific parsing
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	var activity InboxActivity
+	err = json.Unmarshal(body, &activity)
+	if err != nil {
+		http.Error(w, "Error parsing body", http.StatusBadRequest)
+		return
+	}
+	// activities must be signed by their actor, the owner of the signing key is the only actor we trust
+	signer, err := verifySigner(r, body) // defined in secure.go
+	// activities from suspended domains are dropped, but accepted so the sender does not retry them
+	// their keys are not fetched, so this covers activities signed with a key on a suspended domain
+	if errors.Is(err, errDomainBlocked) || (err == nil && isDomainBlocked(uriHost(signer))) { // defined in domainblock.go
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		log.Printf("Rejecting %s activity from %s: %s", activity.Type, activity.Actor, err)
+		w.Header().Set("WWW-Authenticate", `Signature realm="activitypub"`)
+		http.Error(w, "A valid HTTP signature is required", http.StatusUnauthorized)
+		return
+	}
+	if signer != activity.Actor {
+		log.Printf("Rejecting %s activity from %s signed by %s", activity.Type, activity.Actor, signer)
+		http.Error(w, "Activity is not signed by its actor", http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		handleFollow(w, signer, body)
+	case "Undo":
+		handleUndo(activity, body)
+	case "Create":
+		handleCreate(w, activity, signer, body)
+	case "Like", "Announce":
+		handleInteraction(activity, body) // defined in notification.go
+	case "Accept":
+		handleAccept(activity) // defined in follow.go
+	case "Reject":
+		handleReject(activity)
+	case "Move":
+		handleMove(activity, signer) // defined in migrate.go
+	case "Flag":
+		handleFlag(activity, signer, body) // defined in report.go
+	}
+	// other activity types are ignored, returns 200 OK
+}
+
+
+func handleFollow(w http.ResponseWriter, signer string, body []byte) {
 	// parse the follow activity object in request
 	var followObj FollowActivity
-    err := json.NewDecoder(r.Body).Decode(&followObj)
-    if err != nil {
-        http.Error(w, "Error parsing body", http.StatusBadRequest)
-        return
-    }
-
-	// ignore non-follow requests
-	if (followObj.Type != "Follow") {
-		return // returns 200 OK
+	err := json.Unmarshal(body, &followObj)
+	if err != nil {
+		http.Error(w, "Error parsing body", http.StatusBadRequest)
+		return
 	}
 	
 	// check if user exists
@@ -47,11 +95,24 @@ func InboxHandler(w http.ResponseWriter, r *http.Request) {
 		handleErr(err, w, myName) // defined in webfinger.go
 		return
 	}
+	if !checkAccountActive(w, myName) { // defined in account.go
+		return
+	}
 	
-	// send accept message
 	oppInbox := followObj.Actor + "/inbox"
 	actorUrl, _ := url.Parse(followObj.Actor)
 	oppDomain := actorUrl.Hostname()
+
+	// follows from silenced domains are turned down, as there is no way to approve them by hand, and so are follows from blocked actors
+	if isDomainLimited(oppDomain) || isBlocked(myName, signer) { // defined in domainblock.go and block.go
+		rejectObj := getAcceptObj(myName, myDomain, followObj)
+		rejectObj.Type = "Reject"
+		rejectJSONStr, _ := json.Marshal(rejectObj)
+		signAndSendMsg(w, oppInbox, oppDomain, rejectJSONStr, myName, myDomain)
+		return
+	}
+
+	// send accept message
 	acceptObj := getAcceptObj(myName, myDomain, followObj)
 	acceptJSONStr, err := json.Marshal(acceptObj)
 	if err != nil {
@@ -61,7 +122,8 @@ func InboxHandler(w http.ResponseWriter, r *http.Request) {
 
 	// update followers in db
 	followers := getFollowers(w, myName)
-	if !slices.Contains(followers, followObj.Actor) {
+	newFollower := !slices.Contains(followers, followObj.Actor)
+	if newFollower {
 		followers = append(followers, followObj.Actor)
 	}
 	followersJSONStr, _ := json.Marshal(followers)
@@ -75,6 +137,49 @@ func InboxHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	fmt.Println("Updated followers to: ", followers)
+	if newFollower {
+		recordNotification(myName, notificationFollow, followObj.Actor, followObj.Id, "", "") // defined in notification.go
+		triggerWebhooks(myName, notificationFollow, followObj.Actor, body) // defined in webhook.go
+	}
+}
+
+
+// note: currently only handles follows of our accounts being undone, which removes the follower
+func handleUndo(activity InboxActivity, body []byte) {
+	var followObj FollowActivity
+	err := json.Unmarshal(activity.Object, &followObj)
+	if err != nil || followObj.Type != "Follow" || followObj.Actor != activity.Actor {
+		return // object is a link or not a follow by the same actor, nothing to do
+	}
+	myName, ok := localAccountName(followObj.Object) // defined in report.go
+	if !ok || checkUserExists(myName) != nil {
+		return
+	}
+	followers, err := loadFollowers(myName) // defined in user.go
+	if err != nil || !slices.Contains(followers, activity.Actor) {
+		return
+	}
+	err = removeFollower(myName, activity.Actor) // defined in block.go
+	if err != nil {
+		log.Println("Removing follower: ", err)
+		return
+	}
+	triggerWebhooks(myName, webhookUnfollow, activity.Actor, body) // defined in webhook.go
+}
+
+
+// note: currently only handles notes that are votes on one of our polls or are about our accounts
+func handleCreate(w http.ResponseWriter, activity InboxActivity, signer string, body []byte) {
+	var noteObj IncomingNote
+	err := json.Unmarshal(activity.Object, &noteObj)
+	if err != nil || noteObj.Type != "Note" {
+		return // object is a link or not a note, nothing to do
+	}
+	if noteObj.Name != "" && noteObj.InReplyTo != "" {
+		handleVote(w, signer, noteObj) // defined in poll.go
+		return
+	}
+	handleMention(activity, noteObj, body) // defined in notification.go
 }
 
 
@@ -93,36 +198,29 @@ func checkUserExists(name string) error {
 
 
 func signAndSendMsg(w http.ResponseWriter, oppInbox string, oppDomain string, msgJSONStr []byte, myName string, myDomain string) {
-	// getting info we need
-	oppInboxFragment := strings.Replace(oppInbox, "https://" + oppDomain, "", 1)
-	privKey, err := getPrivKey(myName)
+	err := signAndSend(oppInbox, oppDomain, msgJSONStr, myName, myDomain)
 	if err != nil {
 		handleErr(err, w, myName)
-		return
 	}
-	privKeyRSA := parsePrivKeyPEM([]byte(privKey))
-
-	// create digest hash (hash json of message->encode to base 64)
-	hashedMsg := sha256.Sum256(msgJSONStr)
-	digestHash := base64.StdEncoding.EncodeToString(hashedMsg[:])
+}
 
-	// prepare the string to sign
-	d := time.Now().UTC().Format(http.TimeFormat)
-	stringToSign := fmt.Sprintf("(request-target): post %s\nhost: %s\ndate: %s\ndigest: SHA-256=%s", oppInboxFragment, oppDomain, d, digestHash)
 
-	// signing the overall string (hash->sign with privKey->encode to base 64)
-	hashedStringToSign := sha256.Sum256([]byte(stringToSign))
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privKeyRSA, crypto.SHA256, hashedStringToSign[:])
+// same as signAndSendMsg, but reports errors to the caller instead of the client so it can run outside of a request
+func signAndSend(oppInbox string, oppDomain string, msgJSONStr []byte, myName string, myDomain string) error {
+	if isDomainBlocked(oppDomain) { // defined in domainblock.go
+		return errDomainBlocked
+	}
+	if isAccountSuspended(myName) { // defined in account.go
+		return errAccountSuspended
+	}
+	key, err := getHTTPSigKey(myName) // defined in keys.go
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	signatureB64 := base64.StdEncoding.EncodeToString(signature)
 
-	// forming the header signature
-	headerSig := fmt.Sprintf("keyId=\"https://%s/u/%s#main-key\",headers=\"(request-target) host date digest\",signature=\"%s\"", myDomain, myName, signatureB64)
-	
 	// make HTTP request for follower's inbox & log response
-	go sendToHTTP(oppInbox, oppDomain, d, digestHash, headerSig, msgJSONStr)
+	go sendToHTTP(oppInbox, oppDomain, msgJSONStr, key, myName)
+	return nil
 }
 
 
@@ -148,7 +246,7 @@ func getPrivKey(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return key, nil
+	return app.App.Keys.Open(key, dbName) // decrypts keys sealed under the master key
 }
 
 
@@ -177,24 +275,82 @@ func parsePrivKeyPEM(privKeyPEM []byte) (*rsa.PrivateKey) {
 }
 
 
-func sendToHTTP(oppInbox string, oppDomain string, d string, digestHash string, headerSig string, msgJSONStr []byte) {
-    req, _ := http.NewRequest("POST", oppInbox, bytes.NewBuffer(msgJSONStr))
-    req.Header.Set("Host", oppDomain)
-    req.Header.Set("Date", d)
-    req.Header.Set("Digest", "SHA-256="+digestHash)
-    req.Header.Set("Signature", headerSig)
-    req.Header.Set("Content-Type", "application/json")
-    resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Println(err)
+// signs and posts the message, trying the signature format that last worked for the host first
+// on 401 the next format is tried ("double knocking"), and the one that works is recorded for the host
+// the outcome is recorded in the deliveries log of the sending account
+func sendToHTTP(oppInbox string, oppDomain string, msgJSONStr []byte, key httpsig.Key, myName string) {
+	for _, format := range httpsig.Formats(getSignatureFormat(oppDomain), key) {
+		req, _ := http.NewRequest("POST", oppInbox, bytes.NewBuffer(msgJSONStr))
+		req.Header.Set("Content-Type", "application/json")
+		err := httpsig.Sign(req, msgJSONStr, key, format)
+		if err != nil {
+			log.Println(err)
+			recordDelivery(myName, oppInbox, msgJSONStr, 0, string(format), err) // defined in delivery.go
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Println(err)
+			recordDelivery(myName, oppInbox, msgJSONStr, 0, string(format), err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			fmt.Printf("Signature format %s rejected by %s, trying the next one\n", format, oppDomain)
+			continue
+		}
+		if resp.StatusCode < 300 {
+			recordSignatureFormat(oppDomain, format)
+		}
+		fmt.Printf("Response to sending msg: STATUS %s, BODY %s\n", resp.Status, string(body))
+		recordDelivery(myName, oppInbox, msgJSONStr, resp.StatusCode, string(format), nil)
 		return
 	}
-    defer resp.Body.Close()
-    body, _ := io.ReadAll(resp.Body)
-    fmt.Printf("Response to sending msg: STATUS %s, BODY %s\n", resp.Status, string(body))
+	log.Printf("Every signature format was rejected by %s", oppDomain)
+	recordDelivery(myName, oppInbox, msgJSONStr, http.StatusUnauthorized, "", errors.New("every signature format was rejected"))
 }
 
 
+// returns the signature format that last worked for a host, or "" if none has yet
+func getSignatureFormat(host string) httpsig.Format {
+	db := app.App.DB
+	var format string
+	db.QueryRow("SELECT sig_format FROM remote_hosts WHERE host = ?", host).Scan(&format)
+	return httpsig.Format(format)
+}
+
+
+func recordSignatureFormat(host string, format httpsig.Format) {
+	db := app.App.DB
+	_, err := db.Exec("INSERT OR REPLACE INTO remote_hosts(host, sig_format, updated_at) VALUES(?, ?, ?)", host, string(format), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Recording signature format: ", err)
+	}
+}
+
+
+// the fields common to all activities, used to decide how to handle an incoming one
+type InboxActivity struct {
+	Actor string `json:"actor"`
+	Type string `json:"type"`
+	Object json.RawMessage `json:"object"`
+	Target json.RawMessage `json:"target"`
+	Id string `json:"id"`
+}
+
+type IncomingNote struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	InReplyTo string `json:"inReplyTo"`
+	AttributedTo string `json:"attributedTo"`
+	Content string `json:"content"`
+	To json.RawMessage `json:"to"`
+	CC json.RawMessage `json:"cc"`
+	Tag json.RawMessage `json:"tag"`
+}
+
 type FollowActivity struct {
 	Context string `json:"@context"`
 	Actor string `json:"actor"`
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"ap-server/pkg/httpsig"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// the instance actor acts for the server itself (e.g. signing fetches), its record is stored like an account's under DOMAIN@DOMAIN
+func instanceName() string {
+	return app.App.Domain
+}
+
+// returns the URI of a local actor, which for the instance actor is /actor rather than /u/{name}
+func actorURI(name string) string {
+	if name == instanceName() {
+		return fmt.Sprintf("https://%s/actor", app.App.Domain)
+	}
+	return fmt.Sprintf("https://%s/u/%s", app.App.Domain, name)
+}
+
+// creates the instance actor with its keypair at startup if it does not exist yet
+func InitInstanceActor() error {
+	db := app.App.DB
+	domain := app.App.Domain
+	dbName := fmt.Sprintf("%s@%s", instanceName(), domain)
+	var pubKey, actorJSONStr sql.NullString
+	err := db.QueryRow("SELECT pubkey, actor FROM accounts WHERE name = ?", dbName).Scan(&pubKey, &actorJSONStr)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if actorJSONStr.Valid {
+		return nil
+	}
+
+	// the keypair may already exist from before the actor document was stored
+	if !pubKey.Valid {
+		privKey, newPubKey := app.App.KeyPool.Get()
+		sealedPrivKey, err := app.App.Keys.Seal(privKey, dbName)
+		if err != nil {
+			return err
+		}
+		stmt, _ := db.Prepare("INSERT INTO accounts(name, pubkey, privkey) VALUES(?, ?, ?)")
+		_, err = stmt.Exec(dbName, newPubKey, sealedPrivKey)
+		if err != nil {
+			return err
+		}
+		pubKey.String = newPubKey
+	}
+
+	instanceActorJSONStr, _ := json.Marshal(getInstanceActorObj(domain, pubKey.String))
+	webfingerObj := getWebFingerObj(instanceName(), domain) // defined in admin.go
+	webfingerObj.Links[0].Href = actorURI(instanceName())
+	webfingerJSONStr, _ := json.Marshal(webfingerObj)
+	_, err = db.Exec("UPDATE accounts SET actor = ?, webfinger = ? WHERE name = ?", instanceActorJSONStr, webfingerJSONStr, dbName)
+	return err
+}
+
+func InstanceActorHandler(w http.ResponseWriter, r *http.Request) {
+	db := app.App.DB
+	dbName := fmt.Sprintf("%s@%s", instanceName(), app.App.Domain)
+	var actorJSONStr []byte
+	err := db.QueryRow("SELECT actor FROM accounts WHERE name = ?", dbName).Scan(&actorJSONStr)
+	if err != nil {
+		handleErr(err, w, dbName)
+		return
+	}
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.Write(actorJSONStr)
+}
+
+// the instance actor sends nothing publicly, so its outbox is always empty
+func InstanceOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	outboxObj := getOrderedCollectionObj(actorURI(instanceName())+"/outbox", 0, []string{}) // defined in user.go
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(outboxObj)
+}
+
+// returns the key the instance actor signs requests with
+func getInstanceHTTPSigKey() (httpsig.Key, error) {
+	return getHTTPSigKey(instanceName()) // defined in keys.go
+}
+
+func getInstanceActorObj(domain string, pubKey string) InstanceActor {
+	idURI := actorURI(instanceName())
+	return InstanceActor{
+		Context: []string{
+			"https://www.w3.org/ns/activitystreams",
+			"https://w3id.org/security/v1",
+		},
+		ID:                        idURI,
+		Type:                      "Application",
+		PreferredUsername:         domain,
+		Inbox:                     fmt.Sprintf("https://%s/api/inbox", domain),
+		Outbox:                    idURI + "/outbox",
+		ManuallyApprovesFollowers: true,
+		PublicKey: PublicKey{
+			ID:           idURI + "#main-key",
+			Owner:        idURI,
+			PublicKeyPem: pubKey,
+		},
+	}
+}
+
+type InstanceActor struct {
+	Context                   []string  `json:"@context"`
+	ID                        string    `json:"id"`
+	Type                      string    `json:"type"`
+	PreferredUsername         string    `json:"preferredUsername"`
+	Inbox                     string    `json:"inbox"`
+	Outbox                    string    `json:"outbox"`
+	ManuallyApprovesFollowers bool      `json:"manuallyApprovesFollowers"`
+	PublicKey                 PublicKey `json:"publicKey"`
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	errAlreadySent      = errors.New("activity already sent for the object")
+	errObjectNotFetched = errors.New("could not fetch object")
+	errAuthorNotFetched = errors.New("could not fetch the object's author")
+)
+
+// boosts a remote object: Announce to followers and the object's author
+func AnnounceHandler(w http.ResponseWriter, r *http.Request) {
+	interact(w, r, "Announce")
+}
+
+// favourites a remote object: Like to the object's author
+func LikeHandler(w http.ResponseWriter, r *http.Request) {
+	interact(w, r, "Like")
+}
+
+func UndoAnnounceHandler(w http.ResponseWriter, r *http.Request) {
+	undoInteraction(w, r, "Announce")
+}
+
+func UndoLikeHandler(w http.ResponseWriter, r *http.Request) {
+	undoInteraction(w, r, "Like")
+}
+
+func interact(w http.ResponseWriter, r *http.Request, activityType string) {
+	name, ok := checkAccountAuth(w, r, scopePost) // defined in send.go
+	if !ok {
+		return
+	}
+	objectURI := r.FormValue("object")
+	if objectURI == "" {
+		http.Error(w, "Bad request. Please send the URI of the object as 'object'.", http.StatusBadRequest)
+		return
+	}
+
+	activityObj, err := sendInteraction(name, activityType, objectURI)
+	if err == errAlreadySent {
+		http.Error(w, fmt.Sprintf("%s already sent for %s", activityType, objectURI), http.StatusConflict)
+		return
+	}
+	if err == errObjectNotFetched {
+		http.Error(w, "Could not fetch object", http.StatusBadRequest)
+		return
+	}
+	if err == errAuthorNotFetched {
+		http.Error(w, "Could not fetch the object's author", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"id": activityObj.ID, "msg": "ok"})
+}
+
+func undoInteraction(w http.ResponseWriter, r *http.Request, activityType string) {
+	name, ok := checkAccountAuth(w, r, scopePost) // defined in send.go
+	if !ok {
+		return
+	}
+	objectURI := r.FormValue("object")
+
+	db := app.App.DB
+	var guid string
+	var activityJSONStr []byte
+	row := db.QueryRow("SELECT guid, message FROM messages WHERE account = ? AND type = ? AND object = ?", name, activityType, objectURI)
+	err := row.Scan(&guid, &activityJSONStr)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, objectURI)
+		return
+	}
+	_, err = sendUndoInteraction(name, guid, activityJSONStr)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// sends an Announce (to followers and the object's author) or a Like (to the author) of a remote object,
+// storing it so it shows up in the outbox or liked collection; only one of each is sent per object
+func sendInteraction(name string, activityType string, objectURI string) (Activity, error) {
+	db := app.App.DB
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM messages WHERE account = ? AND type = ? AND object = ?", name, activityType, objectURI).Scan(&count)
+	if count > 0 {
+		return Activity{}, errAlreadySent
+	}
+
+	// dereference the object to check that it exists and to find its author's inbox
+	var remoteObj RemoteObject
+	err := fetchJSON(objectURI, &remoteObj) // defined in fetch.go
+	if err != nil || remoteObj.ID == "" {
+		log.Println("Fetching object: ", err)
+		return Activity{}, errObjectNotFetched
+	}
+	author := remoteObj.author()
+	authorActor, err := fetchActor(author)
+	if err != nil {
+		log.Println("Fetching author: ", err)
+		return Activity{}, errAuthorNotFetched
+	}
+
+	guid := createGuid()
+	activityObj := getInteractionObj(guid, name, activityType, remoteObj.ID, author)
+	activityJSONStr, _ := json.Marshal(activityObj)
+	err = storeMessage(guid, activityJSONStr, name, remoteObj.ID) // defined in send.go
+	if err != nil {
+		return Activity{}, err
+	}
+	inboxes := []string{authorActor.Inbox}
+	if activityType == "Announce" {
+		followers, err := loadFollowers(name)
+		if err != nil {
+			return Activity{}, err
+		}
+		for _, follower := range followers {
+			if follower != author {
+				inboxes = append(inboxes, follower+"/inbox")
+			}
+		}
+	}
+	deliverToInboxes(inboxes, activityJSONStr, name) // defined in send.go
+	return activityObj, nil
+}
+
+// sends an Undo of one of the account's stored activities to everyone the activity went to, and forgets it
+func sendUndoInteraction(name string, guid string, activityJSONStr []byte) (Activity, error) {
+	inboxes, err := getRecipientInboxes(name, activityJSONStr)
+	if err != nil {
+		return Activity{}, err
+	}
+	undoObj := getUndoObj(createGuid(), name, json.RawMessage(activityJSONStr))
+	undoJSONStr, _ := json.Marshal(undoObj)
+	deliverToInboxes(inboxes, undoJSONStr, name)
+
+	db := app.App.DB
+	_, err = db.Exec("DELETE FROM messages WHERE guid = ?", guid)
+	return undoObj, err
+}
+
+// resolves the to/cc of an activity we sent into inboxes, expanding our followers collection
+func getRecipientInboxes(name string, activityJSONStr []byte) ([]string, error) {
+	var activity Activity
+	err := json.Unmarshal(activityJSONStr, &activity)
+	if err != nil {
+		return nil, err
+	}
+	return resolveInboxes(name, append(activity.To, activity.CC...))
+}
+
+// resolves recipients into inboxes, expanding our followers collection and leaving out the public collection
+func resolveInboxes(name string, recipients []string) ([]string, error) {
+	followersURI := fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)
+	var inboxes []string
+	for _, recipient := range recipients {
+		switch recipient {
+		case "https://www.w3.org/ns/activitystreams#Public":
+			continue
+		case followersURI:
+			followers, err := loadFollowers(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, follower := range followers {
+				if !slices.Contains(inboxes, follower+"/inbox") {
+					inboxes = append(inboxes, follower+"/inbox")
+				}
+			}
+		default:
+			recipientActor, err := fetchActor(recipient)
+			if err != nil {
+				log.Printf("Fetching recipient %s: %s", recipient, err)
+				continue
+			}
+			if !slices.Contains(inboxes, recipientActor.Inbox) {
+				inboxes = append(inboxes, recipientActor.Inbox)
+			}
+		}
+	}
+	return inboxes, nil
+}
+
+func getInteractionObj(guid string, name string, activityType string, objectURI string, author string) Activity {
+	activityObj := Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    activityType,
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		Object:  objectURI,
+	}
+	if activityType == "Announce" {
+		activityObj.To = []string{"https://www.w3.org/ns/activitystreams#Public"}
+		activityObj.CC = []string{fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name), author}
+	} else {
+		activityObj.To = []string{author}
+	}
+	return activityObj
+}
+
+func getUndoObj(guid string, name string, activityObj interface{}) Activity {
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    "Undo",
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		Object:  activityObj,
+	}
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"ap-server/pkg/httpsig"
+	"ap-server/pkg/utils"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how long a replaced key stays published when no grace_hours is given
+const defaultKeyGracePeriod = 24 * time.Hour
+
+// replaces the account's keypair and federates the new public key via Update
+// the old public key stays published at its key URI until the grace window ends, so in-flight deliveries still verify
+func RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("account")
+	grace := defaultKeyGracePeriod
+	if r.FormValue("grace_hours") != "" {
+		hours, err := strconv.Atoi(r.FormValue("grace_hours"))
+		if err != nil || hours < 0 {
+			http.Error(w, "grace_hours must be a non-negative number of hours", http.StatusBadRequest)
+			return
+		}
+		grace = time.Duration(hours) * time.Hour
+	}
+
+	actorObj, err := getStoredActor(name) // defined in user.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	privKey, pubKey := app.App.KeyPool.Get()
+	keyId := fmt.Sprintf("https://%s/u/%s/keys/%s", app.App.Domain, name, createGuid())
+	dbName := fmt.Sprintf("%s@%s", name, app.App.Domain)
+	sealedPrivKey, err := app.App.Keys.Seal(privKey, dbName)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	oldKey := actorObj.PublicKey
+	actorObj.PublicKey = PublicKey{
+		ID:           keyId,
+		Owner:        actorObj.ID,
+		PublicKeyPem: pubKey,
+	}
+	actorJSONStr, _ := json.Marshal(actorObj)
+
+	// the private key and the key id in the actor change together, so nothing is ever signed with one under the other
+	db := app.App.DB
+	tx, err := db.Begin()
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	// retire the current key, accounts created before key history was kept have no row for it yet
+	_, err = tx.Exec("INSERT OR IGNORE INTO keys(key_id, account, pubkey, created_at) VALUES(?, ?, ?, ?)", oldKey.ID, name, oldKey.PublicKeyPem, now.Format(time.RFC3339))
+	if err == nil {
+		_, err = tx.Exec("UPDATE keys SET retired_at = ?, expires_at = ? WHERE key_id = ?", now.Format(time.RFC3339), now.Add(grace).Format(time.RFC3339), oldKey.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT OR IGNORE INTO keys(key_id, account, pubkey, created_at) VALUES(?, ?, ?, ?)", keyId, name, pubKey, now.Format(time.RFC3339))
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE accounts SET privkey = ?, pubkey = ?, actor = ? WHERE name = ?", sealedPrivKey, pubKey, actorJSONStr, dbName)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	err = federateActor(name, actorObj) // defined in user.go
+	if err != nil {
+		log.Printf("Federating the new key of %s: %s", name, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"keyId": keyId, "msg": "ok"})
+}
+
+// serves a key from the account's key history, or 410 once a replaced key's grace window has ended
+func UserKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	keyId := fmt.Sprintf("https://%s/u/%s/keys/%s", app.App.Domain, name, vars["id"])
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+
+	db := app.App.DB
+	var pubKey string
+	var expiresAt sql.NullString
+	err := db.QueryRow("SELECT pubkey, expires_at FROM keys WHERE key_id = ?", keyId).Scan(&pubKey, &expiresAt)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, keyId)
+		return
+	}
+	if expiresAt.Valid && expiresAt.String <= time.Now().UTC().Format(time.RFC3339) {
+		http.Error(w, "Key has been replaced", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PublicKeyDocument{
+		Context:      "https://w3id.org/security/v1",
+		ID:           keyId,
+		Owner:        fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		PublicKeyPem: pubKey,
+	})
+}
+
+// adds the account's replaced keys whose ids point into its actor document, i.e. the #main-key of accounts
+// created before keys had URIs of their own, to the publicKey of the served actor while their grace window lasts
+// the current key stays first, as servers that read a single key take the first one
+func withRetiredKeys(name string, actorJSONStr []byte) []byte {
+	db := app.App.DB
+	rows, err := db.Query("SELECT key_id, pubkey FROM keys WHERE account = ? AND retired_at IS NOT NULL AND expires_at > ?", name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Getting retired keys from db: ", err)
+		return actorJSONStr
+	}
+	defer rows.Close()
+	actorId := actorURI(name) // defined in instance.go
+	var retired []interface{}
+	for rows.Next() {
+		var keyId, pubKey string
+		rows.Scan(&keyId, &pubKey)
+		if strings.HasPrefix(keyId, actorId+"#") {
+			retired = append(retired, PublicKey{ID: keyId, Owner: actorId, PublicKeyPem: pubKey})
+		}
+	}
+	if len(retired) == 0 {
+		return actorJSONStr
+	}
+
+	var actorObj map[string]json.RawMessage
+	err = json.Unmarshal(actorJSONStr, &actorObj)
+	if err != nil {
+		return actorJSONStr
+	}
+	actorObj["publicKey"], _ = json.Marshal(append([]interface{}{actorObj["publicKey"]}, retired...))
+	patchedJSONStr, _ := json.Marshal(actorObj)
+	return patchedJSONStr
+}
+
+// adds a public key to the account's key history, if it is not there yet
+func recordKey(name string, keyId string, pubKey string) error {
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT OR IGNORE INTO keys(key_id, account, pubkey, created_at) VALUES(?, ?, ?, ?)")
+	_, err := stmt.Exec(keyId, name, pubKey, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// returns the id and private key the account currently signs with, read together so they always match
+func getSigningKey(name string) (string, string, error) {
+	db := app.App.DB
+	dbName := fmt.Sprintf("%s@%s", name, app.App.Domain)
+	var sealedPrivKey string
+	var actorJSONStr []byte
+	err := db.QueryRow("SELECT privkey, actor FROM accounts WHERE name = ?", dbName).Scan(&sealedPrivKey, &actorJSONStr)
+	if err != nil {
+		return "", "", err
+	}
+	var actorObj Actor
+	err = json.Unmarshal(actorJSONStr, &actorObj)
+	if err != nil {
+		return "", "", err
+	}
+	privKey, err := app.App.Keys.Open(sealedPrivKey, dbName) // decrypts keys sealed under the master key
+	return actorObj.PublicKey.ID, privKey, err
+}
+
+// returns the keys the account signs HTTP requests with
+func getHTTPSigKey(name string) (httpsig.Key, error) {
+	keyId, privKey, err := getSigningKey(name)
+	if err != nil {
+		return httpsig.Key{}, err
+	}
+	key := httpsig.Key{
+		ID:  keyId,
+		RSA: parsePrivKeyPEM([]byte(privKey)), // defined in inbox.go
+	}
+	edKeyId, edPrivKey, ok, err := getEd25519SigningKey(name)
+	if err != nil {
+		return httpsig.Key{}, err
+	}
+	if ok {
+		key.Ed25519ID, key.Ed25519 = edKeyId, edPrivKey
+	}
+	return key, nil
+}
+
+// returns the verification method id and Ed25519 private key of the account, ok is false if it has none
+func getEd25519SigningKey(name string) (keyId string, privKey ed25519.PrivateKey, ok bool, err error) {
+	db := app.App.DB
+	dbName := fmt.Sprintf("%s@%s", name, app.App.Domain)
+	var sealedPrivKey sql.NullString
+	err = db.QueryRow("SELECT edprivkey FROM accounts WHERE name = ?", dbName).Scan(&sealedPrivKey)
+	if err != nil || !sealedPrivKey.Valid {
+		return "", nil, false, err
+	}
+	privKeyPEM, err := app.App.Keys.Open(sealedPrivKey.String, dbName+"#ed25519")
+	if err != nil {
+		return "", nil, false, err
+	}
+	privKey, err = utils.ParseEd25519PrivKeyPEM(privKeyPEM)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return fmt.Sprintf("https://%s/u/%s#ed25519-key", app.App.Domain, name), privKey, true, nil
+}
+
+// adds an integrity proof to an activity if the account has an Ed25519 key, otherwise returns it unchanged
+func addIntegrityProof(name string, msgJSONStr []byte) []byte {
+	keyId, privKey, ok, err := getEd25519SigningKey(name)
+	if err != nil {
+		log.Printf("Getting Ed25519 key of %s: %s", name, err)
+	}
+	if !ok {
+		return msgJSONStr
+	}
+	signedJSONStr, err := utils.AddIntegrityProof(msgJSONStr, keyId, privKey)
+	if err != nil {
+		log.Printf("Adding integrity proof for %s: %s", name, err)
+		return msgJSONStr
+	}
+	return signedJSONStr
+}
+
+type PublicKeyDocument struct {
+	Context      string `json:"@context"`
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
@@ -0,0 +1,932 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// the parts of the Mastodon client API (/api/v1) that apps need to sign in, post and show an account's posts
+// apps sign in through /oauth like any other client; account ids are local names and status ids are the guids of posts
+
+// the longest status the API takes, which apps read from the instance
+const mastodonMaxCharacters = 5000
+
+// the creation time given to accounts whose creation time is not known
+const mastodonUnknownDate = "1970-01-01T00:00:00Z"
+
+// the names Mastodon gives the notification types
+var mastodonNotificationTypes = map[string]string{
+	notificationFollow:  "follow",
+	notificationMention: "mention",
+	notificationBoost:   "reblog",
+	notificationLike:    "favourite",
+}
+
+// registers a Mastodon app as a confidential OAuth client, taking the form or JSON parameters Mastodon takes
+func MastodonAppsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := parseFormOrJSON(r); err != nil {
+		writeMastodonErr(w, http.StatusBadRequest, "The body must be a form or a JSON object")
+		return
+	}
+	var redirectURIs []string
+	for _, value := range append(r.Form["redirect_uris"], r.Form["redirect_uris[]"]...) {
+		redirectURIs = append(redirectURIs, strings.Fields(value)...)
+	}
+	scope := r.FormValue("scopes")
+	if scope == "" {
+		scope = "read"
+	}
+	client, err := registerClient(r.FormValue("client_name"), redirectURIs, mastodonScopes(scope), r.FormValue("website"), false) // defined in oauth.go
+	if err != nil {
+		if _, ok := err.(oauthMetadataErr); ok {
+			writeMastodonErr(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	writeMastodonJSON(w, MastodonApplication{
+		ID:           client.ID,
+		Name:         client.Name,
+		Website:      client.Website,
+		Scopes:       strings.Fields(scope),
+		RedirectURI:  strings.Join(client.RedirectURIs, "\n"),
+		RedirectURIs: client.RedirectURIs,
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		VapidKey:     "",
+	})
+}
+
+// returns the account of the token, with the source of its profile
+func MastodonVerifyCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkMastodonAuth(w, r, scopeRead)
+	if !ok {
+		return
+	}
+	account, err := loadMastodonAccount(name)
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	account.Source = &MastodonSource{
+		Privacy:   "public",
+		Note:      "",
+		Fields:    []interface{}{},
+		Sensitive: false,
+		Language:  "",
+	}
+	if effectiveVisibility(name, visibilityPublic) == visibilityFollowers { // defined in account.go
+		account.Source.Privacy = "private"
+	}
+	writeMastodonJSON(w, account)
+}
+
+func MastodonAccountHandler(w http.ResponseWriter, r *http.Request) {
+	account, err := loadMastodonAccount(mux.Vars(r)["id"])
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	writeMastodonJSON(w, account)
+}
+
+// posts a status, or schedules it with scheduled_at; public and unlisted statuses are public posts, private ones
+// are for followers only and direct messages are not supported
+func MastodonPostStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if err := parseFormOrJSON(r); err != nil {
+		writeMastodonErr(w, http.StatusBadRequest, "The body must be a form or a JSON object")
+		return
+	}
+	name, ok := checkMastodonAuth(w, r, scopePost)
+	if !ok {
+		return
+	}
+	text := r.FormValue("status")
+	if strings.TrimSpace(text) == "" {
+		writeMastodonErr(w, http.StatusUnprocessableEntity, "Validation failed: Text can't be blank")
+		return
+	}
+	if len([]rune(text)) > mastodonMaxCharacters {
+		writeMastodonErr(w, http.StatusUnprocessableEntity, fmt.Sprintf("Validation failed: Text is too long (maximum is %d characters)", mastodonMaxCharacters))
+		return
+	}
+	for key := range r.Form {
+		if strings.HasPrefix(key, "poll[") || strings.HasPrefix(key, "media_ids") {
+			writeMastodonErr(w, http.StatusUnprocessableEntity, "Polls are sent with /api/send and media attachments are not supported")
+			return
+		}
+	}
+
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = "public"
+	}
+	var to, cc []string
+	switch visibility {
+	case "public":
+		to, cc = getAddressing(name, visibilityPublic) // defined in send.go
+	case "unlisted":
+		to = []string{fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)}
+		cc = []string{"https://www.w3.org/ns/activitystreams#Public"}
+	case "private":
+		to, cc = getAddressing(name, visibilityFollowers)
+	case "direct":
+		writeMastodonErr(w, http.StatusUnprocessableEntity, "Direct messages are not supported")
+		return
+	default:
+		writeMastodonErr(w, http.StatusUnprocessableEntity, "Validation failed: Visibility is not included in the list")
+		return
+	}
+
+	if r.FormValue("scheduled_at") != "" {
+		scheduledAt, err := parseScheduledAt(r) // defined in schedule.go
+		if err != nil {
+			writeMastodonErr(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		sendVisibility := visibilityPublic
+		if visibility == "private" {
+			sendVisibility = visibilityFollowers
+		}
+		guid, err := schedulePost(plainTextToHTML(text), name, nil, sendVisibility, scheduledAt) // defined in schedule.go
+		if err != nil {
+			writeMastodonStoreErr(w, err)
+			return
+		}
+		writeMastodonJSON(w, MastodonScheduledStatus{
+			ID:          guid,
+			ScheduledAt: scheduledAt.Format(time.RFC3339),
+			Params: MastodonStatusParams{
+				Text:        text,
+				Visibility:  visibility,
+				ScheduledAt: scheduledAt.Format(time.RFC3339),
+			},
+			MediaAttachments: []interface{}{},
+		})
+		return
+	}
+
+	obj := map[string]interface{}{
+		"type":    "Note",
+		"content": plainTextToHTML(text),
+		"to":      to,
+	}
+	if len(cc) > 0 {
+		obj["cc"] = cc
+	}
+	if spoiler := r.FormValue("spoiler_text"); spoiler != "" {
+		obj["summary"] = html.EscapeString(spoiler)
+		obj["sensitive"] = true
+	} else if sensitive, _ := strconv.ParseBool(r.FormValue("sensitive")); sensitive {
+		obj["sensitive"] = true
+	}
+	if replyID := r.FormValue("in_reply_to_id"); replyID != "" {
+		var replyType string
+		err := app.App.DB.QueryRow("SELECT type FROM messages WHERE guid = ? AND (object IS NULL OR object = '')", replyID).Scan(&replyType)
+		if err != nil || replyType == "Tombstone" {
+			writeMastodonErr(w, http.StatusUnprocessableEntity, "Validation failed: the status replied to was not found")
+			return
+		}
+		obj["inReplyTo"] = fmt.Sprintf("https://%s/m/%s", app.App.Domain, replyID)
+	}
+	_, objURI, err := outboxCreate(name, map[string]interface{}{"type": "Create", "object": obj}) // defined in outbox.go
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	guid := strings.TrimPrefix(objURI, fmt.Sprintf("https://%s/m/", app.App.Domain))
+	status, _, err := loadMastodonStatus(guid)
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	writeMastodonJSON(w, status)
+}
+
+// returns a status, those that are not public only to a token of their account
+func MastodonStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, name, err := loadMastodonStatus(mux.Vars(r)["id"])
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	if status.Visibility != "public" && status.Visibility != "unlisted" {
+		// the same as a missing status for anyone else, so it is not revealed that one exists
+		token, ok := bearerToken(r) // defined in token.go
+		if ok {
+			var tokenName string
+			tokenName, err = checkToken(token, scopeRead)
+			ok = err == nil && tokenName == name
+		}
+		if !ok {
+			writeMastodonErr(w, http.StatusNotFound, "Record not found")
+			return
+		}
+	}
+	writeMastodonJSON(w, status)
+}
+
+// deletes one of the account's statuses, returning it with its text as Mastodon does for delete and redraft
+func MastodonDeleteStatusHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkMastodonAuth(w, r, scopePost)
+	if !ok {
+		return
+	}
+	status, statusName, err := loadMastodonStatus(mux.Vars(r)["id"])
+	if err == nil && statusName != name {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	_, err = outboxDelete(name, map[string]interface{}{"type": "Delete", "object": status.URI}) // defined in outbox.go
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	status.Text = status.Content
+	writeMastodonJSON(w, status)
+}
+
+// lists the account's own statuses, newest first, as remote posts are not kept;
+// pages with max_id, since_id and min_id and links to the next and previous pages
+func MastodonHomeTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkMastodonAuth(w, r, scopeRead)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 40 {
+		limit = 40
+	}
+
+	query := "SELECT guid FROM messages WHERE account = ? AND (object IS NULL OR object = '') AND type != 'Tombstone'"
+	args := []interface{}{name}
+	if maxID := r.FormValue("max_id"); maxID != "" {
+		query += " AND (published, guid) < (SELECT published, guid FROM messages WHERE guid = ?)"
+		args = append(args, maxID)
+	}
+	sinceID := r.FormValue("since_id")
+	minID := r.FormValue("min_id")
+	if minID != "" {
+		sinceID = minID
+	}
+	if sinceID != "" {
+		query += " AND (published, guid) > (SELECT published, guid FROM messages WHERE guid = ?)"
+		args = append(args, sinceID)
+	}
+	// min_id pages forward from the id, so the oldest statuses after it are the ones taken
+	if minID != "" {
+		query += " ORDER BY published ASC, guid ASC LIMIT ?"
+	} else {
+		query += " ORDER BY published DESC, guid DESC LIMIT ?"
+	}
+	args = append(args, limit)
+
+	db := app.App.DB
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	var guids []string
+	for rows.Next() {
+		var guid string
+		rows.Scan(&guid)
+		guids = append(guids, guid)
+	}
+	rows.Close()
+	if minID != "" {
+		slices.Reverse(guids)
+	}
+
+	statuses := make([]MastodonStatus, 0, len(guids))
+	for _, guid := range guids {
+		status, _, err := loadMastodonStatus(guid)
+		if err != nil {
+			writeMastodonStoreErr(w, err)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	if len(statuses) > 0 {
+		next := fmt.Sprintf("https://%s/api/v1/timelines/home?limit=%d&max_id=%s", app.App.Domain, limit, statuses[len(statuses)-1].ID)
+		prev := fmt.Sprintf("https://%s/api/v1/timelines/home?limit=%d&min_id=%s", app.App.Domain, limit, statuses[0].ID)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="prev"`, next, prev))
+	}
+	writeMastodonJSON(w, statuses)
+}
+
+// lists the account's notifications as Mastodon notification entities, filtered with types[] and exclude_types[]
+// and paged like the home timeline; likes and boosts of deleted posts are left out
+func MastodonNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkMastodonAuth(w, r, scopeRead)
+	if !ok {
+		return
+	}
+	wanted := append(r.Form["types[]"], r.Form["types"]...)
+	excluded := append(r.Form["exclude_types[]"], r.Form["exclude_types"]...)
+	types := make([]string, 0)
+	for _, t := range notificationTypes { // defined in notification.go
+		theirs := mastodonNotificationTypes[t]
+		if (len(wanted) == 0 || slices.Contains(wanted, theirs)) && !slices.Contains(excluded, theirs) {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		writeMastodonJSON(w, []interface{}{})
+		return
+	}
+	maxID, _ := strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+	sinceID, _ := strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+	minID, _ := strconv.ParseInt(r.FormValue("min_id"), 10, 64)
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = 40
+	}
+	if limit > 80 {
+		limit = 80
+	}
+	notifications, err := loadNotifications(name, types, false, maxID, sinceID, minID, limit) // defined in notification.go
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+
+	entities := make([]MastodonNotification, 0, len(notifications))
+	for _, notification := range notifications {
+		entity := MastodonNotification{
+			ID:        strconv.FormatInt(notification.ID, 10),
+			Type:      mastodonNotificationTypes[notification.Type],
+			CreatedAt: notification.CreatedAt,
+			Account:   mastodonRemoteAccount(notification.Actor),
+		}
+		switch notification.Type {
+		case notificationBoost, notificationLike:
+			status, _, err := loadMastodonStatus(strings.TrimPrefix(notification.Object, fmt.Sprintf("https://%s/m/", app.App.Domain)))
+			if err != nil {
+				continue
+			}
+			entity.Status = &status
+		case notificationMention:
+			entity.Status = &MastodonStatus{
+				ID:               notification.Object,
+				URI:              notification.Object,
+				URL:              notification.Object,
+				CreatedAt:        notification.CreatedAt,
+				Account:          entity.Account,
+				Content:          sanitizeRemoteContent(notification.Content),
+				Visibility:       "public",
+				MediaAttachments: []interface{}{},
+				Mentions:         []interface{}{},
+				Tags:             []interface{}{},
+				Emojis:           []interface{}{},
+			}
+		}
+		entities = append(entities, entity)
+	}
+	if len(notifications) > 0 {
+		next := fmt.Sprintf("https://%s/api/v1/notifications?limit=%d&max_id=%d", app.App.Domain, limit, notifications[len(notifications)-1].ID)
+		prev := fmt.Sprintf("https://%s/api/v1/notifications?limit=%d&min_id=%d", app.App.Domain, limit, notifications[0].ID)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="prev"`, next, prev))
+	}
+	writeMastodonJSON(w, entities)
+}
+
+// turns the HTML content of a remote note into text, then back into HTML made only of paragraphs and line breaks,
+// as apps render the content of statuses as HTML and remote content cannot be trusted
+func sanitizeRemoteContent(content string) string {
+	var text strings.Builder
+	for content != "" {
+		start := strings.IndexByte(content, '<')
+		if start < 0 {
+			text.WriteString(content)
+			break
+		}
+		text.WriteString(content[:start])
+		end := strings.IndexByte(content[start:], '>')
+		if end < 0 {
+			break // an unclosed tag is dropped with the rest of the content
+		}
+		tag := strings.ToLower(content[start+1 : start+end])
+		content = content[start+end+1:]
+		switch name := strings.TrimRight(strings.Fields(tag + " ")[0], "/"); {
+		case name == "br":
+			text.WriteString("\n")
+		case name == "/p" || name == "p" && text.Len() > 0:
+			text.WriteString("\n\n")
+		}
+	}
+
+	return plainTextToHTML(html.UnescapeString(text.String()))
+}
+
+// turns the plain text of a status into HTML, with a paragraph per blank line separated block and line breaks
+// within them, as Mastodon apps send statuses as text
+func plainTextToHTML(text string) string {
+	var paragraphs strings.Builder
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		lines := strings.Split(paragraph, "\n")
+		for i := range lines {
+			lines[i] = html.EscapeString(lines[i])
+		}
+		paragraphs.WriteString("<p>" + strings.Join(lines, "<br />") + "</p>")
+	}
+	return paragraphs.String()
+}
+
+// describes the server to apps, as the v1 instance entity
+func MastodonInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	db := app.App.DB
+	rows, err := db.Query("SELECT name, followers FROM accounts WHERE name != ? AND COALESCE(NULLIF(status, ''), 'active') IN ('active', 'silenced')",
+		fmt.Sprintf("%s@%s", instanceName(), app.App.Domain)) // defined in instance.go
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+	var users int
+	domains := make(map[string]bool)
+	for rows.Next() {
+		var dbName string
+		var followersJSONStr []byte
+		rows.Scan(&dbName, &followersJSONStr)
+		var followers []string
+		json.Unmarshal(followersJSONStr, &followers)
+		for _, follower := range followers {
+			domains[uriHost(follower)] = true // defined in domainblock.go
+		}
+		users++
+	}
+	rows.Close()
+	var statuses int
+	err = db.QueryRow("SELECT COUNT(*) FROM messages WHERE (object IS NULL OR object = '') AND type != 'Tombstone'").Scan(&statuses)
+	if err != nil {
+		writeMastodonStoreErr(w, err)
+		return
+	}
+
+	instance := MastodonInstance{
+		URI:              app.App.Domain,
+		Title:            app.App.Domain,
+		ShortDescription: "An ActivityPub server for sending posts to followers",
+		Description:      "An ActivityPub server for sending posts to followers",
+		Version:          "4.0.0 (compatible; ap-server)",
+		Languages:        []string{},
+		Rules:            []interface{}{},
+	}
+	instance.URLs.StreamingAPI = fmt.Sprintf("wss://%s", app.App.Domain)
+	instance.Stats.UserCount = users
+	instance.Stats.StatusCount = statuses
+	instance.Stats.DomainCount = len(domains)
+	instance.Configuration.Statuses.MaxCharacters = mastodonMaxCharacters
+	instance.Configuration.Statuses.CharactersReservedPerURL = 23
+	instance.Configuration.MediaAttachments.SupportedMimeTypes = []string{}
+	writeMastodonJSON(w, instance)
+}
+
+// turns Mastodon scopes into the scopes of tokens, so Mastodon apps can ask for the scopes they know;
+// scopes that are already token scopes are kept and those with nothing to map to, such as push, are dropped
+func mastodonScopes(scope string) string {
+	scopes := make([]string, 0)
+	add := func(s ...string) {
+		for _, each := range s {
+			if !slices.Contains(scopes, each) {
+				scopes = append(scopes, each)
+			}
+		}
+	}
+	for _, s := range strings.FieldsFunc(scope, func(c rune) bool { return c == ' ' || c == ',' || c == '+' }) {
+		switch {
+		case slices.Contains(tokenScopes, s): // defined in token.go
+			add(s)
+		case s == "read" || s == "profile" || strings.HasPrefix(s, "read:"):
+			add(scopeRead)
+		case s == "write":
+			add(scopePost, scopeFollow)
+		case s == "follow" || s == "write:follows" || s == "write:blocks" || s == "write:mutes":
+			add(scopeFollow)
+		case s == "write:accounts":
+			add(scopeAdminProfile)
+		case strings.HasPrefix(s, "write:"):
+			add(scopePost)
+		default:
+			// push, crypto and admin scopes have nothing here
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// checks the bearer token of a Mastodon API request, answering with a Mastodon error if it is refused
+func checkMastodonAuth(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeMastodonErr(w, http.StatusBadRequest, "Error parsing the form")
+		return "", false
+	}
+	token, ok := bearerToken(r) // defined in token.go
+	if !ok {
+		writeMastodonErr(w, http.StatusUnauthorized, "The access token is invalid")
+		return "", false
+	}
+	name, err := checkToken(token, scope)
+	switch err {
+	case nil:
+		return name, true
+	case errTokenScope:
+		writeMastodonErr(w, http.StatusForbidden, "This action is outside the authorized scopes")
+	case errInvalidToken, errTokenExpired:
+		writeMastodonErr(w, http.StatusUnauthorized, "The access token is invalid")
+	default:
+		log.Println("Checking token: ", err)
+		writeMastodonErr(w, http.StatusInternalServerError, "Error checking token")
+	}
+	return "", false
+}
+
+// fills the form of a request from a JSON body as well as from a urlencoded one, as Mastodon apps send either;
+// arrays become repeated values and nested objects are flattened to key[subkey], as in Rails forms
+func parseFormOrJSON(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	if strings.TrimSpace(mediaType) != "application/json" {
+		return nil
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return err
+	}
+	var add func(key string, value interface{})
+	add = func(key string, value interface{}) {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			r.Form.Add(key, v)
+		case []interface{}:
+			for _, each := range v {
+				add(key, each)
+			}
+		case map[string]interface{}:
+			for subkey, each := range v {
+				add(fmt.Sprintf("%s[%s]", key, subkey), each)
+			}
+		default:
+			r.Form.Add(key, fmt.Sprint(v))
+		}
+	}
+	for key, value := range body {
+		add(key, value)
+	}
+	return nil
+}
+
+// builds the Mastodon account entity of a local account, suspended and deleted accounts are not found
+func loadMastodonAccount(name string) (MastodonAccount, error) {
+	if name == instanceName() || isAccountSuspended(name) {
+		return MastodonAccount{}, sql.ErrNoRows
+	}
+	summary, err := loadAccountSummary(name) // defined in account.go
+	if err != nil {
+		return MastodonAccount{}, err
+	}
+	account := MastodonAccount{
+		ID:             name,
+		Username:       name,
+		Acct:           name,
+		DisplayName:    name,
+		CreatedAt:      summary.CreatedAt,
+		Note:           "",
+		URL:            summary.Actor,
+		URI:            summary.Actor,
+		FollowersCount: summary.FollowersCount,
+		StatusesCount:  summary.PostsCount,
+		Emojis:         []interface{}{},
+		Fields:         []interface{}{},
+	}
+	if account.CreatedAt == "" {
+		account.CreatedAt = mastodonUnknownDate // accounts from before creation times were kept
+	}
+	if summary.LastPostAt != "" {
+		day := summary.LastPostAt[:10]
+		account.LastStatusAt = &day
+	}
+	db := app.App.DB
+	err = db.QueryRow("SELECT COUNT(*) FROM following WHERE account = ? AND accepted = 1", name).Scan(&account.FollowingCount)
+	return account, err
+}
+
+// builds what a Mastodon account entity can say of a remote actor from its URI, as remote actors are not kept
+func mastodonRemoteAccount(actor string) MastodonAccount {
+	username := actor[strings.LastIndex(actor, "/")+1:]
+	return MastodonAccount{
+		ID:          actor,
+		Username:    username,
+		Acct:        fmt.Sprintf("%s@%s", username, uriHost(actor)), // defined in domainblock.go
+		DisplayName: username,
+		CreatedAt:   mastodonUnknownDate,
+		URL:         actor,
+		URI:         actor,
+		Emojis:      []interface{}{},
+		Fields:      []interface{}{},
+	}
+}
+
+// builds the Mastodon status entity of one of the posts stored in messages, returning the account that posted it
+func loadMastodonStatus(guid string) (MastodonStatus, string, error) {
+	db := app.App.DB
+	var msgJSONStr []byte
+	var name, msgType, published sql.NullString
+	err := db.QueryRow("SELECT message, account, type, published FROM messages WHERE guid = ? AND (object IS NULL OR object = '')", guid).
+		Scan(&msgJSONStr, &name, &msgType, &published)
+	if err != nil {
+		return MastodonStatus{}, "", err
+	}
+	if msgType.String == "Tombstone" || isAccountSuspended(name.String) {
+		return MastodonStatus{}, "", sql.ErrNoRows
+	}
+	var obj map[string]interface{}
+	json.Unmarshal(msgJSONStr, &obj)
+	account, err := loadMastodonAccount(name.String)
+	if err != nil {
+		return MastodonStatus{}, "", err
+	}
+
+	status := MastodonStatus{
+		ID:               guid,
+		URI:              fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		CreatedAt:        published.String,
+		Account:          account,
+		Visibility:       "direct",
+		MediaAttachments: []interface{}{},
+		Mentions:         []interface{}{},
+		Tags:             []interface{}{},
+		Emojis:           []interface{}{},
+	}
+	status.URL = status.URI
+	status.Content, _ = obj["content"].(string)
+	spoilerText, _ := obj["summary"].(string)
+	status.SpoilerText = html.UnescapeString(spoilerText) // summaries are HTML, spoiler_text is plain text
+	status.Sensitive, _ = obj["sensitive"].(bool)
+	if status.SpoilerText != "" {
+		status.Sensitive = true
+	}
+	if updated, ok := obj["updated"].(string); ok {
+		status.EditedAt = &updated
+	}
+	if inReplyTo, ok := obj["inReplyTo"].(string); ok {
+		replyGuid := strings.TrimPrefix(inReplyTo, fmt.Sprintf("https://%s/m/", app.App.Domain))
+		var replyName string
+		if db.QueryRow("SELECT account FROM messages WHERE guid = ?", replyGuid).Scan(&replyName) == nil {
+			status.InReplyToID = &replyGuid
+			status.InReplyToAccountID = &replyName
+		}
+	}
+
+	to, cc := mergeRecipients(obj["to"]), mergeRecipients(obj["cc"]) // defined in outbox.go
+	followersURI := fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name.String)
+	switch {
+	case slices.Contains(to, "https://www.w3.org/ns/activitystreams#Public"):
+		status.Visibility = "public"
+	case slices.Contains(cc, "https://www.w3.org/ns/activitystreams#Public"):
+		status.Visibility = "unlisted"
+	case slices.Contains(to, followersURI) || slices.Contains(cc, followersURI):
+		status.Visibility = "private"
+	}
+
+	var pinned int
+	db.QueryRow("SELECT COUNT(*) FROM pinned WHERE account = ? AND guid = ?", name.String, guid).Scan(&pinned)
+	status.Pinned = pinned > 0
+
+	if msgType.String == "Question" {
+		var question Question
+		json.Unmarshal(msgJSONStr, &question)
+		status.Poll = mastodonPoll(guid, question)
+	}
+	return status, name.String, nil
+}
+
+func mastodonPoll(guid string, question Question) *MastodonPoll {
+	poll := &MastodonPoll{
+		ID:          guid,
+		Multiple:    len(question.AnyOf) > 0,
+		VotersCount: question.VotersCount,
+		Emojis:      []interface{}{},
+		OwnVotes:    []int{},
+	}
+	if question.EndTime != "" {
+		poll.ExpiresAt = &question.EndTime
+		endTime, err := time.Parse(time.RFC3339, question.EndTime)
+		poll.Expired = err == nil && time.Now().After(endTime)
+	}
+	if question.Closed != "" {
+		poll.Expired = true
+	}
+	options := question.OneOf
+	if poll.Multiple {
+		options = question.AnyOf
+	}
+	poll.Options = make([]MastodonPollOption, len(options))
+	for i, option := range options {
+		poll.Options[i] = MastodonPollOption{Title: option.Name, VotesCount: option.Replies.TotalItems}
+		poll.VotesCount += option.Replies.TotalItems
+	}
+	return poll
+}
+
+func writeMastodonJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Mastodon apps read errors from JSON, as {"error": "..."}
+func writeMastodonErr(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// the Mastodon API's handleErr, errors shown to outbox clients keep their status
+func writeMastodonStoreErr(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		writeMastodonErr(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	if e, ok := err.(outboxErr); ok {
+		writeMastodonErr(w, e.status, e.msg)
+		return
+	}
+	log.Println(err)
+	writeMastodonErr(w, http.StatusInternalServerError, "Internal server error")
+}
+
+type MastodonApplication struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Website      string   `json:"website"`
+	Scopes       []string `json:"scopes"`
+	RedirectURI  string   `json:"redirect_uri"`
+	RedirectURIs []string `json:"redirect_uris"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	VapidKey     string   `json:"vapid_key"`
+}
+
+type MastodonAccount struct {
+	ID             string          `json:"id"`
+	Username       string          `json:"username"`
+	Acct           string          `json:"acct"`
+	DisplayName    string          `json:"display_name"`
+	Locked         bool            `json:"locked"`
+	Bot            bool            `json:"bot"`
+	Discoverable   bool            `json:"discoverable"`
+	Group          bool            `json:"group"`
+	CreatedAt      string          `json:"created_at"`
+	Note           string          `json:"note"`
+	URL            string          `json:"url"`
+	URI            string          `json:"uri"`
+	Avatar         string          `json:"avatar"`
+	AvatarStatic   string          `json:"avatar_static"`
+	Header         string          `json:"header"`
+	HeaderStatic   string          `json:"header_static"`
+	FollowersCount int             `json:"followers_count"`
+	FollowingCount int             `json:"following_count"`
+	StatusesCount  int             `json:"statuses_count"`
+	LastStatusAt   *string         `json:"last_status_at"`
+	Emojis         []interface{}   `json:"emojis"`
+	Fields         []interface{}   `json:"fields"`
+	Source         *MastodonSource `json:"source,omitempty"` // only for the account's own token
+}
+
+type MastodonSource struct {
+	Privacy   string        `json:"privacy"`
+	Note      string        `json:"note"`
+	Fields    []interface{} `json:"fields"`
+	Sensitive bool          `json:"sensitive"`
+	Language  string        `json:"language"`
+}
+
+type MastodonStatus struct {
+	ID                 string          `json:"id"`
+	URI                string          `json:"uri"`
+	URL                string          `json:"url"`
+	CreatedAt          string          `json:"created_at"`
+	EditedAt           *string         `json:"edited_at"`
+	Account            MastodonAccount `json:"account"`
+	Content            string          `json:"content"`
+	Text               string          `json:"text,omitempty"` // only when the status is deleted
+	Visibility         string          `json:"visibility"`
+	Sensitive          bool            `json:"sensitive"`
+	SpoilerText        string          `json:"spoiler_text"`
+	InReplyToID        *string         `json:"in_reply_to_id"`
+	InReplyToAccountID *string         `json:"in_reply_to_account_id"`
+	Reblog             *MastodonStatus `json:"reblog"`
+	Poll               *MastodonPoll   `json:"poll"`
+	Card               interface{}     `json:"card"`
+	Language           *string         `json:"language"`
+	MediaAttachments   []interface{}   `json:"media_attachments"`
+	Mentions           []interface{}   `json:"mentions"`
+	Tags               []interface{}   `json:"tags"`
+	Emojis             []interface{}   `json:"emojis"`
+	RepliesCount       int             `json:"replies_count"`
+	ReblogsCount       int             `json:"reblogs_count"`
+	FavouritesCount    int             `json:"favourites_count"`
+	Favourited         bool            `json:"favourited"`
+	Reblogged          bool            `json:"reblogged"`
+	Muted              bool            `json:"muted"`
+	Bookmarked         bool            `json:"bookmarked"`
+	Pinned             bool            `json:"pinned"`
+}
+
+type MastodonNotification struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt string          `json:"created_at"`
+	Account   MastodonAccount `json:"account"`
+	Status    *MastodonStatus `json:"status,omitempty"`
+}
+
+type MastodonPoll struct {
+	ID          string               `json:"id"`
+	ExpiresAt   *string              `json:"expires_at"`
+	Expired     bool                 `json:"expired"`
+	Multiple    bool                 `json:"multiple"`
+	VotesCount  int                  `json:"votes_count"`
+	VotersCount int                  `json:"voters_count"`
+	Options     []MastodonPollOption `json:"options"`
+	Emojis      []interface{}        `json:"emojis"`
+	Voted       bool                 `json:"voted"`
+	OwnVotes    []int                `json:"own_votes"`
+}
+
+type MastodonPollOption struct {
+	Title      string `json:"title"`
+	VotesCount int    `json:"votes_count"`
+}
+
+type MastodonScheduledStatus struct {
+	ID               string               `json:"id"`
+	ScheduledAt      string               `json:"scheduled_at"`
+	Params           MastodonStatusParams `json:"params"`
+	MediaAttachments []interface{}        `json:"media_attachments"`
+}
+
+type MastodonStatusParams struct {
+	Text        string `json:"text"`
+	Visibility  string `json:"visibility"`
+	ScheduledAt string `json:"scheduled_at"`
+}
+
+type MastodonInstance struct {
+	URI              string `json:"uri"`
+	Title            string `json:"title"`
+	ShortDescription string `json:"short_description"`
+	Description      string `json:"description"`
+	Email            string `json:"email"`
+	Version          string `json:"version"`
+	URLs             struct {
+		StreamingAPI string `json:"streaming_api"`
+	} `json:"urls"`
+	Stats struct {
+		UserCount   int `json:"user_count"`
+		StatusCount int `json:"status_count"`
+		DomainCount int `json:"domain_count"`
+	} `json:"stats"`
+	Thumbnail        *string  `json:"thumbnail"`
+	Languages        []string `json:"languages"`
+	Registrations    bool     `json:"registrations"`
+	ApprovalRequired bool     `json:"approval_required"`
+	InvitesEnabled   bool     `json:"invites_enabled"`
+	Configuration    struct {
+		Statuses struct {
+			MaxCharacters            int `json:"max_characters"`
+			MaxMediaAttachments      int `json:"max_media_attachments"`
+			CharactersReservedPerURL int `json:"characters_reserved_per_url"`
+		} `json:"statuses"`
+		MediaAttachments struct {
+			SupportedMimeTypes []string `json:"supported_mime_types"`
+		} `json:"media_attachments"`
+	} `json:"configuration"`
+	ContactAccount *MastodonAccount `json:"contact_account"`
+	Rules          []interface{}    `json:"rules"`
+}
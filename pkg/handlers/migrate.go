@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/exp/slices"
+)
+
+// sets the actor's alsoKnownAs, which the old account's server checks before moving its followers to us
+func AliasesHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeAdminProfile) // defined in send.go
+	if !ok {
+		return
+	}
+
+	// every alias has to resolve to an actor, we store the id it reports
+	aliases := make([]string, 0)
+	for _, alias := range r.Form["aliases"] {
+		aliasActor, err := fetchActor(alias) // defined in fetch.go
+		if err != nil {
+			log.Println("Fetching alias: ", err)
+			http.Error(w, fmt.Sprintf("Could not fetch actor %s", alias), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(aliases, aliasActor.ID) {
+			aliases = append(aliases, aliasActor.ID)
+		}
+	}
+
+	actorObj, err := getStoredActor(name) // defined in user.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	actorObj.AlsoKnownAs = aliases
+	err = updateStoredActor(name, actorObj)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"alsoKnownAs": aliases, "msg": "ok"})
+}
+
+// moves the account to the target actor, which must list it in alsoKnownAs, and tells followers via Move
+func MoveHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeAdminProfile) // defined in send.go
+	if !ok {
+		return
+	}
+	myURI := fmt.Sprintf("https://%s/u/%s", app.App.Domain, name)
+	targetActor, err := fetchActor(r.FormValue("target"))
+	if err != nil {
+		log.Println("Fetching move target: ", err)
+		http.Error(w, "Could not fetch the target actor", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(targetActor.AlsoKnownAs, myURI) {
+		http.Error(w, fmt.Sprintf("The target actor must list %s in alsoKnownAs", myURI), http.StatusBadRequest)
+		return
+	}
+
+	actorObj, err := getStoredActor(name) // defined in user.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	actorObj.MovedTo = targetActor.ID
+	err = updateStoredActor(name, actorObj)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	followers, err := loadFollowers(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	moveJSONStr, _ := json.Marshal(getMoveObj(createGuid(), name, targetActor.ID))
+	deliverToFollowers(followers, moveJSONStr, name) // defined in send.go
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// re-follows the target of a Move for every local account that follows the moved actor
+// signer is the owner of the key the Move was signed with, which must be the moved actor
+func handleMove(activity InboxActivity, signer string) {
+	source := activity.Actor
+	if signer == "" || signer != source {
+		log.Printf("Ignoring move of %s signed by %q", source, signer)
+		return
+	}
+	if referenceID(activity.Object) != source {
+		return // actors can only move themselves
+	}
+	target := referenceID(activity.Target)
+
+	db := app.App.DB
+	rows, err := db.Query("SELECT account FROM following WHERE target = ?", source)
+	if err != nil {
+		log.Println("Getting following from db: ", err)
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	rows.Close()
+	if len(names) == 0 {
+		return // none of our accounts follow the moved actor
+	}
+
+	// the target has to confirm the move by listing the source as an alias
+	targetActor, err := fetchActor(target)
+	if err != nil {
+		log.Printf("Fetching move target %s: %s", target, err)
+		return
+	}
+	if !slices.Contains(targetActor.AlsoKnownAs, source) {
+		log.Printf("Ignoring move of %s to %s: target does not list it in alsoKnownAs", source, target)
+		return
+	}
+
+	for _, name := range names {
+		_, err = sendUnfollow(name, source) // defined in follow.go
+		if err != nil {
+			log.Printf("Unfollowing %s for %s: %s", source, name, err)
+		}
+		_, err = sendFollow(name, targetActor.ID)
+		if err != nil {
+			log.Printf("Following %s for %s: %s", targetActor.ID, name, err)
+		}
+	}
+}
+
+func getMoveObj(guid string, name string, target string) Activity {
+	myURI := fmt.Sprintf("https://%s/u/%s", app.App.Domain, name)
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    "Move",
+		Actor:   myURI,
+		To:      []string{fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)},
+		Object:  myURI,
+		Target:  target,
+	}
+}
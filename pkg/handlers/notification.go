@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// what a notification is about
+const (
+	notificationFollow  = "follow"  // an actor followed the account
+	notificationMention = "mention" // a note mentions the account, addresses it directly or replies to one of its posts
+	notificationBoost   = "boost"   // one of the account's posts was announced
+	notificationLike    = "like"    // one of the account's posts was liked
+)
+
+var notificationTypes = []string{notificationFollow, notificationMention, notificationBoost, notificationLike}
+
+// lists the account's notifications, newest first: 'types' (repeated or comma separated) keeps only those types,
+// 'unread=true' only unread ones, and 'max_id' and 'since_id' page through them 'limit' at a time (20, at most 40)
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeRead) // defined in send.go
+	if !ok {
+		return
+	}
+	types, err := parseNotificationTypes(r.Form["types"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxID, _ := strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+	sinceID, _ := strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 40 {
+		limit = 40
+	}
+	unreadOnly, _ := strconv.ParseBool(r.FormValue("unread"))
+
+	list := NotificationList{}
+	list.Notifications, err = loadNotifications(name, types, unreadOnly, maxID, sinceID, 0, limit)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if len(list.Notifications) == limit {
+		list.NextMaxID = list.Notifications[len(list.Notifications)-1].ID
+	}
+	list.Unread, err = countUnreadNotifications(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+func UnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeRead) // defined in send.go
+	if !ok {
+		return
+	}
+	unread, err := countUnreadNotifications(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+// marks the notifications given by 'ids' (repeated or comma separated) as read, or all of them up to 'max_id',
+// or all of them if neither is given
+func ReadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeRead) // defined in send.go
+	if !ok {
+		return
+	}
+	query := "UPDATE notifications SET read = 1 WHERE account = ? AND read = 0"
+	args := []interface{}{name}
+	var ids []string
+	for _, value := range r.Form["ids"] {
+		ids = append(ids, strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' })...)
+	}
+	if len(ids) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	} else if r.FormValue("max_id") != "" {
+		maxID, err := strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "max_id must be a notification id", http.StatusBadRequest)
+			return
+		}
+		query += " AND id <= ?"
+		args = append(args, maxID)
+	}
+	db := app.App.DB
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// records that a remote actor did something to one of our accounts, unless the account blocked the actor
+// a redelivered activity is only recorded once
+func recordNotification(name string, notificationType string, actor string, activityID string, object string, content string) {
+	if isAccountSuspended(name) || isBlocked(name, actor) { // defined in account.go and block.go
+		return
+	}
+	var activityIDStr sql.NullString
+	if activityID != "" {
+		activityIDStr = sql.NullString{String: activityID, Valid: true}
+	}
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT OR IGNORE INTO notifications(account, type, actor, activity_id, object, content, read, created_at) VALUES(?, ?, ?, ?, ?, ?, 0, ?)")
+	_, err := stmt.Exec(name, notificationType, actor, activityIDStr, object, content, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Recording notification: ", err)
+	}
+}
+
+// notifies the authors of our posts that a Like or Announce is about them
+func handleInteraction(activity InboxActivity, body []byte) {
+	notificationType := notificationLike
+	if activity.Type == "Announce" {
+		notificationType = notificationBoost
+	}
+	for _, objURI := range referenceIDs(activity.Object) { // defined in fetch.go
+		if name, ok := localPostAuthor(objURI); ok {
+			recordNotification(name, notificationType, activity.Actor, activity.Id, objURI, "")
+			triggerWebhooks(name, notificationType, activity.Actor, body) // defined in webhook.go
+		}
+	}
+}
+
+// notifies our accounts that a note is about them: mentioned in its tags, addressed directly or replied to
+// webhooks get a reply event for the author of the post replied to, and a mention event for the others
+func handleMention(activity InboxActivity, noteObj IncomingNote, body []byte) {
+	names := make([]string, 0)
+	add := func(name string) {
+		if !slices.Contains(names, name) && checkUserExists(name) == nil { // defined in inbox.go
+			names = append(names, name)
+		}
+	}
+	var tags []IncomingTag
+	if json.Unmarshal(noteObj.Tag, &tags) != nil {
+		var tag IncomingTag
+		if json.Unmarshal(noteObj.Tag, &tag) == nil {
+			tags = []IncomingTag{tag}
+		}
+	}
+	for _, tag := range tags {
+		if name, ok := localAccountName(tag.Href); ok && tag.Type == "Mention" { // defined in report.go
+			add(name)
+		}
+	}
+	for _, recipient := range append(referenceIDs(noteObj.To), referenceIDs(noteObj.CC)...) {
+		if name, ok := localAccountName(recipient); ok {
+			add(name)
+		}
+	}
+	repliedTo, _ := localPostAuthor(noteObj.InReplyTo)
+	if repliedTo != "" {
+		add(repliedTo)
+	}
+	for _, name := range names {
+		recordNotification(name, notificationMention, activity.Actor, activity.Id, noteObj.Id, noteObj.Content)
+		if name == repliedTo {
+			triggerWebhooks(name, webhookReply, activity.Actor, body) // defined in webhook.go
+		} else {
+			triggerWebhooks(name, notificationMention, activity.Actor, body)
+		}
+	}
+}
+
+// returns the account that published one of our posts, from its id
+func localPostAuthor(objURI string) (string, bool) {
+	prefix := fmt.Sprintf("https://%s/m/", app.App.Domain)
+	if !strings.HasPrefix(objURI, prefix) {
+		return "", false
+	}
+	var name sql.NullString
+	err := app.App.DB.QueryRow("SELECT account FROM messages WHERE guid = ?", strings.TrimPrefix(objURI, prefix)).Scan(&name)
+	return name.String, err == nil && name.String != ""
+}
+
+// loads the account's notifications of the given types (all if none are given), newest first, with ids below
+// maxID and above sinceID when they are not 0
+// minID also takes the ids above it, but the oldest of them rather than the newest, to page forward from it
+func loadNotifications(name string, types []string, unreadOnly bool, maxID int64, sinceID int64, minID int64, limit int) ([]Notification, error) {
+	query := "SELECT id, type, actor, activity_id, object, content, read, created_at FROM notifications WHERE account = ?"
+	args := []interface{}{name}
+	if len(types) > 0 {
+		query += " AND type IN (?" + strings.Repeat(", ?", len(types)-1) + ")"
+		for _, t := range types {
+			args = append(args, t)
+		}
+	}
+	if unreadOnly {
+		query += " AND read = 0"
+	}
+	if maxID > 0 {
+		query += " AND id < ?"
+		args = append(args, maxID)
+	}
+	if sinceID > 0 {
+		query += " AND id > ?"
+		args = append(args, sinceID)
+	}
+	if minID > 0 {
+		query += " AND id > ? ORDER BY id ASC LIMIT ?"
+		args = append(args, minID, limit)
+	} else {
+		query += " ORDER BY id DESC LIMIT ?"
+		args = append(args, limit)
+	}
+
+	db := app.App.DB
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := make([]Notification, 0)
+	for rows.Next() {
+		var notification Notification
+		var activityID, object, content sql.NullString
+		rows.Scan(&notification.ID, &notification.Type, &notification.Actor, &activityID, &object, &content, &notification.Read, &notification.CreatedAt)
+		notification.ActivityID = activityID.String
+		notification.Object = object.String
+		notification.Content = content.String
+		notifications = append(notifications, notification)
+	}
+	if minID > 0 {
+		slices.Reverse(notifications)
+	}
+	return notifications, nil
+}
+
+func countUnreadNotifications(name string) (int, error) {
+	var unread int
+	err := app.App.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE account = ? AND read = 0", name).Scan(&unread)
+	return unread, err
+}
+
+// splits the types form values, which may each hold several types separated by spaces or commas
+func parseNotificationTypes(values []string) ([]string, error) {
+	types := make([]string, 0)
+	for _, value := range values {
+		for _, t := range strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' }) {
+			if !slices.Contains(notificationTypes, t) {
+				return nil, fmt.Errorf("unknown notification type %s, types are %s", t, strings.Join(notificationTypes, ", "))
+			}
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+type Notification struct {
+	ID         int64  `json:"id"`
+	Type       string `json:"type"`
+	Actor      string `json:"actor"`
+	ActivityID string `json:"activity_id,omitempty"`
+	Object     string `json:"object,omitempty"`  // the post liked or boosted, or the note mentioning the account
+	Content    string `json:"content,omitempty"` // the content of a mentioning note
+	Read       bool   `json:"read"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type NotificationList struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+	NextMaxID     int64          `json:"next_max_id,omitempty"` // set when there may be older notifications
+}
+
+type IncomingTag struct {
+	Type string `json:"type"`
+	Href string `json:"href"`
+}
@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// OAuth 2.0 for client apps: dynamic registration (RFC 7591), the authorization code flow with PKCE (RFC 7636),
+// refresh tokens, introspection (RFC 7662) and revocation (RFC 7009)
+// access tokens are stored in the tokens table, so every route that takes a token takes them
+
+const (
+	oauthCodeLifetime  = 10 * time.Minute
+	oauthTokenLifetime = 24 * time.Hour
+	// the redirect URI of apps that have the user copy the code instead, as Mastodon has it
+	oauthOutOfBand = "urn:ietf:wg:oauth:2.0:oob"
+)
+
+var errInvalidClient = errors.New("invalid client")
+
+// registers a client app from a JSON client metadata document, as RFC 7591 describes
+// apps that register with the token_endpoint_auth_method none are public and get no secret, they have to use PKCE
+func OAuthRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var metadata OAuthClient
+	err := json.NewDecoder(r.Body).Decode(&metadata)
+	if err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_client_metadata", "the body must be a JSON client metadata document")
+		return
+	}
+	client, err := registerClient(metadata.Name, metadata.RedirectURIs, metadata.Scope, metadata.Website, metadata.TokenEndpointAuthMethod == "none")
+	if err != nil {
+		if _, ok := err.(oauthMetadataErr); ok {
+			writeOAuthErr(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+			return
+		}
+		handleErr(err, w, metadata.Name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(client)
+}
+
+// shows the login and consent page for an authorization request
+func OAuthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := checkAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	renderConsentPage(w, http.StatusOK, req, "")
+}
+
+// handles the consent page: the account signs in with its name and API key and approves or denies the app
+func OAuthApproveHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := checkAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.FormValue("decision") != "approve" {
+		redirectAuthorizeErr(w, r, req, "access_denied", "the account denied the request")
+		return
+	}
+	name := r.FormValue("acct")
+	matched, err := checkAPIKey(r.FormValue("apikey"), name) // defined in send.go
+	if err != nil && err != sql.ErrNoRows {
+		handleErr(err, w, name)
+		return
+	}
+	if !matched {
+		renderConsentPage(w, http.StatusUnauthorized, req, "Wrong account name or API key")
+		return
+	}
+
+	code := createToken() // defined in token.go
+	db := app.App.DB
+	_, err = db.Exec("DELETE FROM oauth_codes WHERE expires_at < ?", time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Removing expired authorization codes: ", err)
+	}
+	stmt, _ := db.Prepare("INSERT INTO oauth_codes(hash, client_id, account, redirect_uri, scopes, code_challenge, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	_, err = stmt.Exec(hashToken(code), req.Client.ID, name, req.RedirectURI, strings.Join(req.Scopes, " "), req.CodeChallenge, time.Now().UTC().Add(oauthCodeLifetime).Format(time.RFC3339))
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if req.RedirectURI == oauthOutOfBand {
+		renderCodePage(w, req, code)
+		return
+	}
+	redirectAuthorize(w, r, req, url.Values{"code": {code}})
+}
+
+// exchanges an authorization code or a refresh token for an access token
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := parseFormOrJSON(r); err != nil { // defined in mastodon.go, as Mastodon apps may send JSON
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "the body must be a form")
+		return
+	}
+	client, err := authenticateClient(r)
+	if err != nil {
+		writeClientErr(w, err)
+		return
+	}
+
+	var token OAuthToken
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		token, err = exchangeCode(client, r.FormValue("code"), r.FormValue("redirect_uri"), r.FormValue("code_verifier"))
+	case "refresh_token":
+		token, err = refreshToken(client, r.FormValue("refresh_token"))
+	default:
+		writeOAuthErr(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+	if err == errInvalidToken {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "the code or refresh token is invalid, expired or was issued to another client")
+		return
+	}
+	if err != nil {
+		handleErr(err, w, client.ID)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+// tells a client whether a token it was issued is active, and what it is for
+func OAuthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "the body must be a form")
+		return
+	}
+	client, err := authenticateClient(r)
+	if err == nil && client.Public {
+		err = errInvalidClient // only clients that can keep a secret can introspect
+	}
+	if err != nil {
+		writeClientErr(w, err)
+		return
+	}
+
+	inactive := map[string]bool{"active": false}
+	db := app.App.DB
+	var name, scopes, createdAt string
+	var expiresAt sql.NullString
+	var isAccessToken bool
+	hash := hashToken(r.FormValue("token"))
+	err = db.QueryRow("SELECT account, scopes, created_at, expires_at, hash = ? FROM tokens WHERE (hash = ? OR refresh_hash = ?) AND client_id = ?", hash, hash, hash, client.ID).
+		Scan(&name, &scopes, &createdAt, &expiresAt, &isAccessToken)
+	w.Header().Set("Content-Type", "application/json")
+	if err == sql.ErrNoRows || isAccountSuspended(name) { // defined in account.go
+		json.NewEncoder(w).Encode(inactive)
+		return
+	}
+	if err != nil {
+		handleErr(err, w, client.ID)
+		return
+	}
+	introspection := OAuthIntrospection{
+		Active:    true,
+		Scope:     scopes,
+		ClientID:  client.ID,
+		Username:  name,
+		Sub:       actorURI(name), // defined in instance.go
+		TokenType: "refresh_token",
+	}
+	if issuedAt, err := time.Parse(time.RFC3339, createdAt); err == nil {
+		introspection.Iat = issuedAt.Unix()
+	}
+	if isAccessToken {
+		introspection.TokenType = "Bearer"
+		if expiry, err := time.Parse(time.RFC3339, expiresAt.String); err == nil {
+			if !expiry.After(time.Now()) {
+				json.NewEncoder(w).Encode(inactive)
+				return
+			}
+			introspection.Exp = expiry.Unix()
+		}
+	}
+	json.NewEncoder(w).Encode(introspection)
+}
+
+// revokes an access or refresh token along with the other one issued with it
+func OAuthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "the body must be a form")
+		return
+	}
+	client, err := authenticateClient(r)
+	if err != nil {
+		writeClientErr(w, err)
+		return
+	}
+	hash := hashToken(r.FormValue("token"))
+	db := app.App.DB
+	_, err = db.Exec("DELETE FROM tokens WHERE (hash = ? OR refresh_hash = ?) AND client_id = ?", hash, hash, client.ID)
+	if err != nil {
+		handleErr(err, w, client.ID)
+		return
+	}
+	// unknown tokens are not an error, as RFC 7009 has it
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{})
+}
+
+// serves the authorization server metadata of RFC 8414, so clients can find the endpoints
+func OAuthMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	base := fmt.Sprintf("https://%s", app.App.Domain)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                base,
+		"authorization_endpoint":                base + "/oauth/authorize",
+		"token_endpoint":                        base + "/oauth/token",
+		"registration_endpoint":                 base + "/oauth/register",
+		"introspection_endpoint":                base + "/oauth/introspect",
+		"revocation_endpoint":                   base + "/oauth/revoke",
+		"scopes_supported":                      tokenScopes, // defined in token.go
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// stores a new client app, public apps get no secret
+func registerClient(clientName string, redirectURIs []string, scope string, website string, public bool) (OAuthClient, error) {
+	if clientName == "" {
+		return OAuthClient{}, oauthMetadataErr("client_name is required")
+	}
+	if len(redirectURIs) == 0 {
+		return OAuthClient{}, oauthMetadataErr("redirect_uris is required")
+	}
+	for _, redirectURI := range redirectURIs {
+		if redirectURI == oauthOutOfBand {
+			continue
+		}
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return OAuthClient{}, oauthMetadataErr(fmt.Sprintf("%s is not an absolute URI without a fragment", redirectURI))
+		}
+	}
+	if scope == "" {
+		scope = scopeRead // defined in token.go
+	}
+	scopes, err := parseScopes([]string{scope}) // defined in token.go
+	if err != nil {
+		return OAuthClient{}, oauthMetadataErr(err.Error())
+	}
+
+	client := OAuthClient{
+		ID:                      createGuid(),
+		IssuedAt:                time.Now().Unix(),
+		Name:                    clientName,
+		RedirectURIs:            redirectURIs,
+		Scope:                   strings.Join(scopes, " "),
+		Website:                 website,
+		TokenEndpointAuthMethod: "client_secret_basic",
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		Public:                  public,
+	}
+	var secretHash sql.NullString
+	if public {
+		client.TokenEndpointAuthMethod = "none"
+	} else {
+		client.Secret = createToken()
+		secretHash = sql.NullString{String: hashToken(client.Secret), Valid: true}
+	}
+	redirectURIsJSONStr, _ := json.Marshal(redirectURIs)
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO oauth_clients(client_id, secret_hash, name, redirect_uris, scopes, website, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	_, err = stmt.Exec(client.ID, secretHash, client.Name, redirectURIsJSONStr, client.Scope, client.Website, time.Now().UTC().Format(time.RFC3339))
+	return client, err
+}
+
+func loadClient(clientID string) (OAuthClient, error) {
+	db := app.App.DB
+	var client OAuthClient
+	var secretHash, website sql.NullString
+	var redirectURIsJSONStr []byte
+	err := db.QueryRow("SELECT client_id, secret_hash, name, redirect_uris, scopes, website FROM oauth_clients WHERE client_id = ?", clientID).
+		Scan(&client.ID, &secretHash, &client.Name, &redirectURIsJSONStr, &client.Scope, &website)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	json.Unmarshal(redirectURIsJSONStr, &client.RedirectURIs)
+	client.Website = website.String
+	client.Public = !secretHash.Valid
+	client.secretHash = secretHash.String
+	return client, nil
+}
+
+// identifies the client of a token, introspection or revocation request, with HTTP Basic or the client_id and
+// client_secret form values; public clients only give their client_id
+func authenticateClient(r *http.Request) (OAuthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	client, err := loadClient(clientID)
+	if err == sql.ErrNoRows {
+		return OAuthClient{}, errInvalidClient
+	}
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	if !client.Public && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.secretHash)) != 1 {
+		return OAuthClient{}, errInvalidClient
+	}
+	return client, nil
+}
+
+// checks the parameters of an authorization request, responding with an error if they are wrong
+// errors about the client or redirect URI are shown rather than redirected, so nothing is sent to an unknown URI
+func checkAuthorizeRequest(w http.ResponseWriter, r *http.Request) (authorizeRequest, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return authorizeRequest{}, false
+	}
+	client, err := loadClient(r.FormValue("client_id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return authorizeRequest{}, false
+	}
+	if err != nil {
+		handleErr(err, w, r.FormValue("client_id"))
+		return authorizeRequest{}, false
+	}
+	req := authorizeRequest{
+		Client:              client,
+		RedirectURI:         r.FormValue("redirect_uri"),
+		State:               r.FormValue("state"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		http.Error(w, "redirect_uri is not registered for the client", http.StatusBadRequest)
+		return authorizeRequest{}, false
+	}
+
+	if r.FormValue("response_type") != "code" {
+		redirectAuthorizeErr(w, r, req, "unsupported_response_type", "response_type must be code")
+		return authorizeRequest{}, false
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = client.Scope
+	}
+	req.Scopes, err = parseScopes([]string{mastodonScopes(scope)}) // defined in mastodon.go
+	if err != nil {
+		redirectAuthorizeErr(w, r, req, "invalid_scope", err.Error())
+		return authorizeRequest{}, false
+	}
+	for _, s := range req.Scopes {
+		if !slices.Contains(strings.Fields(client.Scope), s) {
+			redirectAuthorizeErr(w, r, req, "invalid_scope", fmt.Sprintf("the client is not registered for the %s scope", s))
+			return authorizeRequest{}, false
+		}
+	}
+	// public clients cannot authenticate the code exchange, so they have to prove it with PKCE
+	if req.CodeChallenge == "" && client.Public {
+		redirectAuthorizeErr(w, r, req, "invalid_request", "code_challenge is required")
+		return authorizeRequest{}, false
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		redirectAuthorizeErr(w, r, req, "invalid_request", "code_challenge_method must be S256")
+		return authorizeRequest{}, false
+	}
+	return req, true
+}
+
+// sends the user agent back to the client with the given parameters and the state
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, req authorizeRequest, params url.Values) {
+	if req.RedirectURI == oauthOutOfBand {
+		http.Error(w, params.Get("error_description"), http.StatusBadRequest)
+		return
+	}
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func redirectAuthorizeErr(w http.ResponseWriter, r *http.Request, req authorizeRequest, code string, description string) {
+	redirectAuthorize(w, r, req, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// trades an authorization code for a token, the code can only be used once
+func exchangeCode(client OAuthClient, code string, redirectURI string, verifier string) (OAuthToken, error) {
+	db := app.App.DB
+	var clientID, name, codeRedirectURI, scopes, challenge, expiresAt string
+	err := db.QueryRow("DELETE FROM oauth_codes WHERE hash = ? RETURNING client_id, account, redirect_uri, scopes, code_challenge, expires_at", hashToken(code)).
+		Scan(&clientID, &name, &codeRedirectURI, &scopes, &challenge, &expiresAt)
+	if err == sql.ErrNoRows {
+		return OAuthToken{}, errInvalidToken // defined in token.go
+	}
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if clientID != client.ID || codeRedirectURI != redirectURI || expiresAt <= time.Now().UTC().Format(time.RFC3339) {
+		return OAuthToken{}, errInvalidToken
+	}
+	if challenge != "" {
+		sum := sha256.Sum256([]byte(verifier))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) != 1 {
+			return OAuthToken{}, errInvalidToken
+		}
+	}
+	if isAccountSuspended(name) { // defined in account.go
+		return OAuthToken{}, errInvalidToken
+	}
+	return issueOAuthToken(client, name, scopes)
+}
+
+// stores a new access token for the account along with a refresh token, the app's name naming it
+func issueOAuthToken(client OAuthClient, name string, scopes string) (OAuthToken, error) {
+	token := OAuthToken{
+		AccessToken:  createToken(),
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthTokenLifetime.Seconds()),
+		RefreshToken: createToken(),
+		Scope:        scopes,
+		CreatedAt:    time.Now().Unix(),
+	}
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO tokens(id, account, name, hash, scopes, created_at, expires_at, client_id, refresh_hash) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	_, err := stmt.Exec(createGuid(), name, client.Name, hashToken(token.AccessToken), scopes, time.Now().UTC().Format(time.RFC3339),
+		time.Now().UTC().Add(oauthTokenLifetime).Format(time.RFC3339), client.ID, hashToken(token.RefreshToken))
+	return token, err
+}
+
+// replaces the access and refresh tokens of a grant, the old refresh token stops working
+func refreshToken(client OAuthClient, refresh string) (OAuthToken, error) {
+	db := app.App.DB
+	var id, name, scopes string
+	err := db.QueryRow("SELECT id, account, scopes FROM tokens WHERE refresh_hash = ? AND client_id = ?", hashToken(refresh), client.ID).Scan(&id, &name, &scopes)
+	if err == sql.ErrNoRows {
+		return OAuthToken{}, errInvalidToken
+	}
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if isAccountSuspended(name) {
+		return OAuthToken{}, errInvalidToken
+	}
+	token := OAuthToken{
+		AccessToken:  createToken(),
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthTokenLifetime.Seconds()),
+		RefreshToken: createToken(),
+		Scope:        scopes,
+		CreatedAt:    time.Now().Unix(),
+	}
+	_, err = db.Exec("UPDATE tokens SET hash = ?, refresh_hash = ?, expires_at = ? WHERE id = ?",
+		hashToken(token.AccessToken), hashToken(token.RefreshToken), time.Now().UTC().Add(oauthTokenLifetime).Format(time.RFC3339), id)
+	return token, err
+}
+
+func writeOAuthErr(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func writeClientErr(w http.ResponseWriter, err error) {
+	if err == errInvalidClient {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthErr(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong client secret")
+		return
+	}
+	log.Println("Authenticating OAuth client: ", err)
+	writeOAuthErr(w, http.StatusInternalServerError, "server_error", "error authenticating the client")
+}
+
+func renderConsentPage(w http.ResponseWriter, status int, req authorizeRequest, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY") // the page must not be framed by the app asking for access
+	w.WriteHeader(status)
+	err := consentPage.Execute(w, map[string]interface{}{
+		"Domain":  app.App.Domain,
+		"Request": req,
+		"Error":   errMsg,
+	})
+	if err != nil {
+		log.Println("Rendering consent page: ", err)
+	}
+}
+
+func renderCodePage(w http.ResponseWriter, req authorizeRequest, code string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	err := codePage.Execute(w, map[string]interface{}{"Request": req, "Code": code})
+	if err != nil {
+		log.Println("Rendering code page: ", err)
+	}
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <title>Authorize {{.Request.Client.Name}}</title>
+  <style>
+  body { font-family: sans-serif; max-width: 600px; margin: 30px; }
+  input { width: 300px; font-size: 1.2em; }
+  button { font-size: 1.2em; }
+  .error { color: #b00; }
+  </style>
+</head>
+<body>
+<h1>Authorize {{.Request.Client.Name}}</h1>
+{{if .Request.Client.Website}}<p><a href="{{.Request.Client.Website}}">{{.Request.Client.Website}}</a></p>{{end}}
+<p>{{.Request.Client.Name}} wants to use your account on {{.Domain}} to:</p>
+<ul>
+{{range .Request.Scopes}}<li>{{.}}</li>{{end}}
+</ul>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+  <input type="hidden" name="response_type" value="code"/>
+  <input type="hidden" name="client_id" value="{{.Request.Client.ID}}"/>
+  <input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}"/>
+  <input type="hidden" name="scope" value="{{range $i, $s := .Request.Scopes}}{{if $i}} {{end}}{{$s}}{{end}}"/>
+  <input type="hidden" name="state" value="{{.Request.State}}"/>
+  <input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}"/>
+  <input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}"/>
+  <p><input name="acct" type="text" placeholder="myAccountName" autocomplete="username"/></p>
+  <p><input name="apikey" type="password" placeholder="API key" autocomplete="current-password"/></p>
+  <button type="submit" name="decision" value="approve">Authorize</button>
+  <button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+var codePage = template.Must(template.New("code").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <title>Authorization code</title>
+</head>
+<body style="font-family: sans-serif; margin: 30px;">
+<h1>Authorization code</h1>
+<p>Copy this code into {{.Request.Client.Name}}:</p>
+<p><code>{{.Code}}</code></p>
+</body>
+</html>
+`))
+
+// an error in the metadata a client registers with, shown to it
+type oauthMetadataErr string
+
+func (e oauthMetadataErr) Error() string {
+	return string(e)
+}
+
+type authorizeRequest struct {
+	Client              OAuthClient
+	RedirectURI         string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+type OAuthClient struct {
+	ID                      string   `json:"client_id"`
+	Secret                  string   `json:"client_secret,omitempty"`
+	IssuedAt                int64    `json:"client_id_issued_at"`
+	SecretExpiresAt         int64    `json:"client_secret_expires_at"`
+	Name                    string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	Scope                   string   `json:"scope"`
+	Website                 string   `json:"client_uri,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	Public                  bool     `json:"-"`
+	secretHash              string
+}
+
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type OAuthIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope"`
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	Sub       string `json:"sub"`
+	TokenType string `json:"token_type"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat"`
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// serves an object or activity sent by one of our accounts at its id
+// followers-only posts are only served to requests signed by a follower of the author
+func ObjectHandler(w http.ResponseWriter, r *http.Request) {
+	guid := mux.Vars(r)["guid"]
+	signer, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	var msgJSONStr []byte
+	var name, msgType sql.NullString
+	err := db.QueryRow("SELECT message, account, type FROM messages WHERE guid = ?", guid).Scan(&msgJSONStr, &name, &msgType)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, guid)
+		return
+	}
+	if isAccountSuspended(name.String) { // defined in account.go
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	if msgType.String == "Tombstone" { // a deleted post, defined in outbox.go
+		w.Header().Set("Content-Type", "application/activity+json")
+		w.WriteHeader(http.StatusGone)
+		w.Write(msgJSONStr)
+		return
+	}
+	if !isPublicMessage(msgJSONStr) { // defined in send.go
+		err = checkFollowerAccess(name.String, signer)
+		if err == errNotFollower {
+			// same as a missing object, so it is not revealed that one exists
+			http.Error(w, fmt.Sprintf("No record found for %s", guid), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleErr(err, w, guid)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.Write(msgJSONStr)
+}
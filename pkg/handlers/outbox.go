@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// the activities a client can post to an outbox
+var outboxActivityTypes = []string{"Create", "Update", "Delete", "Follow", "Like", "Announce", "Undo", "Block"}
+
+// the other ActivityStreams activity types, which are refused; anything else posted is an object and wrapped in a Create
+var otherActivityTypes = []string{"Accept", "Add", "Arrive", "Dislike", "Flag", "Ignore", "Invite", "Join", "Leave", "Listen", "Move", "Offer", "Read", "Reject", "Remove", "TentativeAccept", "TentativeReject", "Travel", "View"}
+
+// takes an activity, or a bare object to wrap in a Create, from a client of the account, as the ActivityPub
+// client to server protocol describes: the activity is given a new id, its side effects are carried out
+// and it is delivered, then its id is returned in the Location header
+func PostOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading the body", http.StatusBadRequest)
+		return
+	}
+	var activity map[string]interface{}
+	err = json.Unmarshal(body, &activity)
+	activityType, _ := activity["type"].(string)
+	if err != nil || activityType == "" {
+		http.Error(w, "Bad request. Please send an ActivityStreams activity or object as JSON.", http.StatusBadRequest)
+		return
+	}
+	if slices.Contains(otherActivityTypes, activityType) {
+		http.Error(w, fmt.Sprintf("%s activities cannot be posted to the outbox", activityType), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(outboxActivityTypes, activityType) {
+		activity = map[string]interface{}{
+			"@context": "https://www.w3.org/ns/activitystreams",
+			"type":     "Create",
+			"object":   activity,
+		}
+		activityType = "Create"
+	}
+
+	scope := scopePost // defined in token.go
+	if activityType == "Follow" || activityType == "Block" || (activityType == "Undo" && isFollowOrBlock(name, outboxObjectID(activity["object"]))) {
+		scope = scopeFollow
+	}
+	authName, ok := checkAccountAuth(w, r, scope) // defined in send.go
+	if !ok {
+		return
+	}
+	if authName != name {
+		http.Error(w, "Not allowed to post to the outbox of another account", http.StatusForbidden)
+		return
+	}
+	if actor, ok := activity["actor"].(string); ok && actor != actorURI(name) { // defined in instance.go
+		http.Error(w, "The actor of the activity must be the owner of the outbox", http.StatusBadRequest)
+		return
+	}
+
+	var id string
+	switch activityType {
+	case "Create":
+		id, _, err = outboxCreate(name, activity)
+	case "Update":
+		id, err = outboxUpdate(name, activity)
+	case "Delete":
+		id, err = outboxDelete(name, activity)
+	case "Follow":
+		var followObj FollowActivity
+		followObj, err = sendFollow(name, outboxObjectID(activity["object"])) // defined in follow.go
+		if err != nil {
+			log.Println("Sending follow: ", err)
+			err = outboxErr{http.StatusBadRequest, "Could not follow actor"}
+		}
+		id = followObj.Id
+	case "Like", "Announce":
+		var activityObj Activity
+		activityObj, err = sendInteraction(name, activityType, outboxObjectID(activity["object"])) // defined in interact.go
+		switch err {
+		case errAlreadySent:
+			err = outboxErr{http.StatusConflict, fmt.Sprintf("%s already sent for the object", activityType)}
+		case errObjectNotFetched, errAuthorNotFetched:
+			err = outboxErr{http.StatusBadRequest, "Could not fetch the object or its author"}
+		}
+		id = activityObj.ID
+	case "Block":
+		var blockObj Activity
+		blockObj, err = sendBlock(name, outboxObjectID(activity["object"])) // defined in block.go
+		switch err {
+		case errAlreadyBlocked:
+			err = outboxErr{http.StatusConflict, "Actor is already blocked"}
+		case errInvalidTarget:
+			err = outboxErr{http.StatusBadRequest, "A Block needs the URI of an actor as its object"}
+		}
+		id = blockObj.ID
+	case "Undo":
+		id, err = outboxUndo(name, outboxObjectID(activity["object"]))
+	}
+	if e, ok := err.(outboxErr); ok {
+		http.Error(w, e.msg, e.status)
+		return
+	}
+	if err != nil {
+		handleErr(err, w, outboxObjectID(activity["object"]))
+		return
+	}
+
+	w.Header().Set("Location", id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// gives the object of a Create and the Create new ids, addresses both alike, stores them and delivers the Create
+// returns the ids of the Create and of its object
+func outboxCreate(name string, activity map[string]interface{}) (string, string, error) {
+	obj, ok := activity["object"].(map[string]interface{})
+	if !ok {
+		return "", "", outboxErr{http.StatusBadRequest, "A Create needs an embedded object"}
+	}
+	objType, _ := obj["type"].(string)
+	if objType == "" || slices.Contains(outboxActivityTypes, objType) || slices.Contains(otherActivityTypes, objType) {
+		return "", "", outboxErr{http.StatusBadRequest, "The object of a Create must be an object, not an activity"}
+	}
+	if objType == "Question" {
+		return "", "", outboxErr{http.StatusBadRequest, "Polls are sent with /api/send"}
+	}
+
+	// the activity and its object share their addressing, which is public if the client gives none
+	to := mergeRecipients(activity["to"], obj["to"])
+	cc := mergeRecipients(activity["cc"], obj["cc"])
+	blind := append(mergeRecipients(activity["bto"], obj["bto"]), mergeRecipients(activity["bcc"], obj["bcc"])...)
+	if len(to) == 0 && len(cc) == 0 && len(blind) == 0 {
+		to, cc = getAddressing(name, visibilityPublic) // defined in send.go
+	}
+	if effectiveVisibility(name, visibilityPublic) == visibilityFollowers { // defined in account.go
+		to, cc = withoutPublic(name, to, cc)
+	}
+	for _, addressed := range []map[string]interface{}{activity, obj} {
+		delete(addressed, "bto")
+		delete(addressed, "bcc")
+		addressed["to"] = to
+		if len(cc) > 0 {
+			addressed["cc"] = cc
+		} else {
+			delete(addressed, "cc")
+		}
+	}
+
+	guidObj, guidCreate := createGuid(), createGuid()
+	objURI := fmt.Sprintf("https://%s/m/%s", app.App.Domain, guidObj)
+	obj["id"] = objURI
+	obj["attributedTo"] = actorURI(name)
+	obj["published"] = time.Now().UTC().Format(time.RFC3339)
+	activity["id"] = fmt.Sprintf("https://%s/m/%s", app.App.Domain, guidCreate)
+	activity["actor"] = actorURI(name)
+	if _, ok := activity["@context"]; !ok {
+		activity["@context"] = "https://www.w3.org/ns/activitystreams"
+	}
+
+	objJSONStr, _ := json.Marshal(obj)
+	createJSONStr, _ := json.Marshal(activity)
+	err := storeMessage(guidObj, objJSONStr, name, "") // defined in send.go
+	if err != nil {
+		return "", "", err
+	}
+	err = storeMessage(guidCreate, createJSONStr, name, objURI)
+	if err != nil {
+		return "", "", err
+	}
+	err = deliverToRecipients(name, append(append(to, cc...), blind...), createJSONStr)
+	return activity["id"].(string), objURI, err
+}
+
+// applies a partial update to one of the account's posts: the properties given replace the stored ones and
+// those given as null are removed, then an Update with the whole object is sent to its audience
+func outboxUpdate(name string, activity map[string]interface{}) (string, error) {
+	changes, ok := activity["object"].(map[string]interface{})
+	if !ok {
+		return "", outboxErr{http.StatusBadRequest, "An Update needs an embedded object"}
+	}
+	objURI, _ := changes["id"].(string)
+	guid, obj, err := loadOwnObject(name, objURI)
+	if err != nil {
+		return "", err
+	}
+	if obj["type"] == "Question" {
+		return "", outboxErr{http.StatusBadRequest, "Polls cannot be edited"}
+	}
+	for key, value := range changes {
+		switch key {
+		case "id", "type", "attributedTo", "published", "to", "cc":
+			continue // the object keeps its identity and audience
+		}
+		if value == nil {
+			delete(obj, key)
+		} else {
+			obj[key] = value
+		}
+	}
+	obj["updated"] = time.Now().UTC().Format(time.RFC3339)
+
+	objJSONStr, _ := json.Marshal(obj)
+	db := app.App.DB
+	_, err = db.Exec("UPDATE messages SET message = ? WHERE guid = ?", objJSONStr, guid)
+	if err != nil {
+		return "", err
+	}
+	// the Create in the outbox embeds the object, so it is updated too
+	var guidCreate string
+	var createJSONStr []byte
+	err = db.QueryRow("SELECT guid, message FROM messages WHERE account = ? AND type = 'Create' AND object = ?", name, objURI).Scan(&guidCreate, &createJSONStr)
+	if err == nil {
+		var createObj map[string]interface{}
+		json.Unmarshal(createJSONStr, &createObj)
+		createObj["object"] = obj
+		createJSONStr, _ = json.Marshal(createObj)
+		_, err = db.Exec("UPDATE messages SET message = ? WHERE guid = ?", createJSONStr, guidCreate)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	to, cc := mergeRecipients(obj["to"]), mergeRecipients(obj["cc"])
+	return sendOutboxActivity(name, "Update", obj, objURI, to, cc)
+}
+
+// replaces one of the account's posts with a Tombstone, takes it out of the outbox and sends a Delete to its audience
+func outboxDelete(name string, activity map[string]interface{}) (string, error) {
+	objURI := outboxObjectID(activity["object"])
+	guid, obj, err := loadOwnObject(name, objURI)
+	if err != nil {
+		return "", err
+	}
+	to, cc := mergeRecipients(obj["to"]), mergeRecipients(obj["cc"])
+	tombstone := map[string]interface{}{
+		"id":         objURI,
+		"type":       "Tombstone",
+		"formerType": obj["type"],
+		"deleted":    time.Now().UTC().Format(time.RFC3339),
+	}
+	tombstoneJSONStr, _ := json.Marshal(tombstone)
+
+	db := app.App.DB
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE messages SET message = ?, type = 'Tombstone' WHERE guid = ?", tombstoneJSONStr, guid)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM messages WHERE account = ? AND type = 'Create' AND object = ?", name, objURI)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM pinned WHERE account = ? AND guid = ?", name, guid)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM poll_votes WHERE poll = ?", guid)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM polls WHERE guid = ?", guid)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return sendOutboxActivity(name, "Delete", tombstone, objURI, to, cc)
+}
+
+// undoes one of the account's Likes, Announces, Follows or Blocks, found by its id
+func outboxUndo(name string, activityURI string) (string, error) {
+	db := app.App.DB
+	guid := strings.TrimPrefix(activityURI, fmt.Sprintf("https://%s/m/", app.App.Domain))
+	var activityJSONStr []byte
+	err := db.QueryRow("SELECT message FROM messages WHERE guid = ? AND account = ? AND type IN ('Like', 'Announce')", guid, name).Scan(&activityJSONStr)
+	if err == nil {
+		undoObj, err := sendUndoInteraction(name, guid, activityJSONStr) // defined in interact.go
+		return undoObj.ID, err
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var target string
+	err = db.QueryRow("SELECT target FROM following WHERE account = ? AND follow_id = ?", name, activityURI).Scan(&target)
+	if err == nil {
+		undoObj, err := sendUnfollow(name, target) // defined in follow.go
+		return undoObj.ID, err
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	err = db.QueryRow("SELECT target FROM blocks WHERE account = ? AND block_id = ?", name, activityURI).Scan(&target)
+	if err != nil {
+		return "", err // no such activity is a 404
+	}
+	undoObj, err := sendUnblock(name, target) // defined in block.go
+	return undoObj.ID, err
+}
+
+// stores an activity about one of the account's posts and delivers it to the post's audience
+func sendOutboxActivity(name string, activityType string, obj interface{}, objURI string, to []string, cc []string) (string, error) {
+	guid := createGuid()
+	activityObj := Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    activityType,
+		Actor:   actorURI(name),
+		To:      to,
+		CC:      cc,
+		Object:  obj,
+	}
+	activityJSONStr, _ := json.Marshal(activityObj)
+	err := storeMessage(guid, activityJSONStr, name, objURI)
+	if err != nil {
+		return "", err
+	}
+	return activityObj.ID, deliverToRecipients(name, append(to, cc...), activityJSONStr)
+}
+
+// delivers an activity to the inboxes of its remote recipients
+func deliverToRecipients(name string, recipients []string, activityJSONStr []byte) error {
+	followersURI := fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)
+	remote := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if recipient == followersURI || uriHost(recipient) != app.App.Domain { // defined in domainblock.go
+			remote = append(remote, recipient)
+		}
+	}
+	inboxes, err := resolveInboxes(name, remote) // defined in interact.go
+	if err != nil {
+		return err
+	}
+	deliverToInboxes(inboxes, activityJSONStr, name) // defined in send.go
+	return nil
+}
+
+// loads one of the account's posts by its id, refusing anything else it stored, such as activities
+func loadOwnObject(name string, objURI string) (string, map[string]interface{}, error) {
+	prefix := fmt.Sprintf("https://%s/m/", app.App.Domain)
+	if !strings.HasPrefix(objURI, prefix) {
+		return "", nil, outboxErr{http.StatusBadRequest, "The object must be one of the account's posts"}
+	}
+	guid := strings.TrimPrefix(objURI, prefix)
+	db := app.App.DB
+	var objType string
+	var objJSONStr []byte
+	err := db.QueryRow("SELECT type, message FROM messages WHERE guid = ? AND account = ?", guid, name).Scan(&objType, &objJSONStr)
+	if err != nil {
+		return "", nil, err
+	}
+	if objType == "Tombstone" {
+		return "", nil, outboxErr{http.StatusGone, "The post was deleted"}
+	}
+	if slices.Contains(outboxActivityTypes, objType) || slices.Contains(otherActivityTypes, objType) {
+		return "", nil, outboxErr{http.StatusBadRequest, "The object must be one of the account's posts"}
+	}
+	var obj map[string]interface{}
+	err = json.Unmarshal(objJSONStr, &obj)
+	return guid, obj, err
+}
+
+// whether the id is one of the account's Follows or Blocks, which need the follow scope to be undone
+func isFollowOrBlock(name string, activityURI string) bool {
+	db := app.App.DB
+	var count int
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM following WHERE account = ? AND follow_id = ?) + (SELECT COUNT(*) FROM blocks WHERE account = ? AND block_id = ?)",
+		name, activityURI, name, activityURI).Scan(&count)
+	return count > 0
+}
+
+// returns the id of an object given by reference or embedded
+func outboxObjectID(object interface{}) string {
+	switch o := object.(type) {
+	case string:
+		return o
+	case map[string]interface{}:
+		id, _ := o["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// collects the recipients of addressing properties, which can each be a single URI or a list
+func mergeRecipients(values ...interface{}) []string {
+	recipients := make([]string, 0)
+	for _, value := range values {
+		var uris []interface{}
+		switch v := value.(type) {
+		case string:
+			uris = []interface{}{v}
+		case []interface{}:
+			uris = v
+		case []string:
+			for _, s := range v {
+				uris = append(uris, s)
+			}
+		}
+		for _, uri := range uris {
+			if s := outboxObjectID(uri); s != "" && !slices.Contains(recipients, s) {
+				recipients = append(recipients, s)
+			}
+		}
+	}
+	return recipients
+}
+
+// takes the public collection out of the addressing of a silenced account's post, making sure its followers are addressed
+func withoutPublic(name string, to []string, cc []string) ([]string, []string) {
+	followersURI := fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)
+	public := func(uri string) bool { return uri == "https://www.w3.org/ns/activitystreams#Public" }
+	to = slices.DeleteFunc(to, public)
+	cc = slices.DeleteFunc(cc, public)
+	if !slices.Contains(to, followersURI) && !slices.Contains(cc, followersURI) {
+		to = append(to, followersURI)
+	}
+	return to, cc
+}
+
+// an error in what a client posted to the outbox, shown to it with the status
+type outboxErr struct {
+	status int
+	msg    string
+}
+
+func (e outboxErr) Error() string {
+	return e.msg
+}
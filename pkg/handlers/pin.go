@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// same limit as Mastodon, which ignores pins past it
+const maxPinned = 5
+
+// serves the user's pinned notes as an OrderedCollection, most recently pinned first
+func UserFeaturedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := checkUserExists(name) // defined in inbox.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+	_, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	rows, err := db.Query("SELECT m.message FROM pinned p JOIN messages m ON m.guid = p.guid WHERE p.account = ? ORDER BY p.pinned_at DESC", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	notes := make([]json.RawMessage, 0)
+	for rows.Next() {
+		var noteJSONStr []byte
+		rows.Scan(&noteJSONStr)
+		notes = append(notes, noteJSONStr)
+	}
+
+	featuredObj := getOrderedCollectionObj(getFeaturedURI(name), len(notes), notes) // defined in user.go
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(featuredObj)
+}
+
+func PinHandler(w http.ResponseWriter, r *http.Request) {
+	name, guid, ok := checkPinRequest(w, r)
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM pinned WHERE account = ?", name).Scan(&count)
+	if count >= maxPinned {
+		http.Error(w, fmt.Sprintf("At most %d posts can be pinned", maxPinned), http.StatusBadRequest)
+		return
+	}
+	stmt, _ := db.Prepare("INSERT INTO pinned(account, guid, pinned_at) VALUES(?, ?, ?)")
+	_, err := stmt.Exec(name, guid, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		http.Error(w, "Post is already pinned", http.StatusConflict)
+		return
+	}
+
+	sendFeaturedChange(w, name, guid, "Add")
+}
+
+func UnpinHandler(w http.ResponseWriter, r *http.Request) {
+	name, guid, ok := checkPinRequest(w, r)
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	res, err := db.Exec("DELETE FROM pinned WHERE account = ? AND guid = ?", name, guid)
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Post is not pinned", http.StatusBadRequest)
+		return
+	}
+
+	sendFeaturedChange(w, name, guid, "Remove")
+}
+
+// checks the API key and that the id form value (a guid or full URI) is a note the account sent, returns both
+func checkPinRequest(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	name, ok := checkAccountAuth(w, r, scopePost) // defined in send.go
+	if !ok {
+		return "", "", false
+	}
+	guid := strings.TrimPrefix(r.FormValue("id"), fmt.Sprintf("https://%s/m/", app.App.Domain))
+
+	db := app.App.DB
+	var msgType string
+	var msgJSONStr []byte
+	err := db.QueryRow("SELECT type, message FROM messages WHERE guid = ? AND account = ?", guid, name).Scan(&msgType, &msgJSONStr)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, guid)
+		return "", "", false
+	}
+	if msgType != "Note" && msgType != "Question" {
+		http.Error(w, "Only posts can be pinned", http.StatusBadRequest)
+		return "", "", false
+	}
+	// the featured collection is public, so followers-only posts stay out of it
+	if !isPublicMessage(msgJSONStr) { // defined in send.go
+		http.Error(w, "Followers-only posts cannot be pinned", http.StatusBadRequest)
+		return "", "", false
+	}
+	return name, guid, true
+}
+
+// federates an Add/Remove of the note to/from the featured collection, and responds
+func sendFeaturedChange(w http.ResponseWriter, name string, guid string, activityType string) {
+	followers, err := loadFollowers(name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	noteURI := fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid)
+	activityObj := getFeaturedChangeObj(createGuid(), name, activityType, noteURI)
+	activityJSONStr, _ := json.Marshal(activityObj)
+	deliverToFollowers(followers, activityJSONStr, name) // defined in send.go
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+func getFeaturedChangeObj(guid string, name string, activityType string, noteURI string) Activity {
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    activityType,
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		To:      []string{"https://www.w3.org/ns/activitystreams#Public"},
+		CC:      []string{fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)},
+		Object:  noteURI,
+		Target:  getFeaturedURI(name),
+	}
+}
+
+func getFeaturedURI(name string) string {
+	return fmt.Sprintf("https://%s/u/%s/collections/featured", app.App.Domain, name)
+}
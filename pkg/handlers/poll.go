@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// how often the background closer checks for polls that have ended, and sends the counts of polls that got votes
+const pollCloseInterval = time.Minute
+
+// validates the poll fields of a send request
+func parsePollForm(r *http.Request) (PollForm, error) {
+	var options []string
+	for _, option := range r.Form["poll_options"] {
+		option = strings.TrimSpace(option)
+		if option != "" && !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+	if len(options) < 2 {
+		return PollForm{}, errors.New("a poll needs at least two distinct options")
+	}
+	endTime, err := time.Parse(time.RFC3339, r.FormValue("poll_end_time"))
+	if err != nil {
+		return PollForm{}, errors.New("poll_end_time must be an RFC 3339 timestamp")
+	}
+	if !endTime.After(time.Now()) {
+		return PollForm{}, errors.New("poll_end_time must be in the future")
+	}
+	return PollForm{
+		Options:  options,
+		Multiple: r.FormValue("poll_multiple") == "true",
+		EndTime:  endTime.UTC(),
+	}, nil
+}
+
+func sendPollToFollowers(msg string, name string, poll PollForm, visibility string) error {
+	visibility = effectiveVisibility(name, visibility) // defined in account.go
+	guidQuestion := createGuid()
+	questionObj := getQuestionObj(guidQuestion, msg, name, poll, visibility)
+
+	// register the poll before publishing so early votes are not dropped
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO polls(guid, account, multiple, end_time, closed, dirty) VALUES(?, ?, ?, ?, 0, 0)")
+	_, err := stmt.Exec(guidQuestion, name, poll.Multiple, poll.EndTime.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	err = publishToFollowers(guidQuestion, questionObj, name, visibility) // defined in send.go
+	if err != nil {
+		db.Exec("DELETE FROM polls WHERE guid = ?", guidQuestion)
+	}
+	return err
+}
+
+// records a vote from a remote actor and stores the new counts, which are federated by the poll closer
+// voter is the owner of the key the vote was signed with, votes attributed to anyone else are ignored
+func handleVote(w http.ResponseWriter, voter string, noteObj IncomingNote) {
+	if voter == "" || (noteObj.AttributedTo != "" && noteObj.AttributedTo != voter) {
+		return
+	}
+	guid := strings.TrimPrefix(noteObj.InReplyTo, fmt.Sprintf("https://%s/m/", app.App.Domain))
+	if guid == noteObj.InReplyTo {
+		return // not a reply to one of our objects
+	}
+
+	db := app.App.DB
+	row := db.QueryRow("SELECT multiple, end_time, closed FROM polls WHERE guid = ?", guid)
+	var multiple, closed bool
+	var endTimeStr string
+	err := row.Scan(&multiple, &endTimeStr, &closed)
+	if err == sql.ErrNoRows {
+		return // reply to something that is not a poll
+	}
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	endTime, _ := time.Parse(time.RFC3339, endTimeStr)
+	if closed || time.Now().After(endTime) {
+		return // votes after the end time are ignored
+	}
+
+	questionObj, err := getQuestion(guid)
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	if !slices.ContainsFunc(questionObj.options(), func(o PollOption) bool { return o.Name == noteObj.Name }) {
+		return // not one of the poll's options
+	}
+
+	// one vote per signing actor (per option for multiple choice polls), checked in the insert so that
+	// concurrent deliveries cannot both count
+	stmt, _ := db.Prepare("INSERT OR IGNORE INTO poll_votes(poll, voter, choice) SELECT ?, ?, ? WHERE ? OR NOT EXISTS (SELECT 1 FROM poll_votes WHERE poll = ? AND voter = ?)")
+	res, err := stmt.Exec(guid, voter, noteObj.Name, multiple, guid, voter)
+	if err != nil {
+		log.Println("Adding poll vote to db: ", err)
+		http.Error(w, "Error when handling request", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return // already voted
+	}
+
+	_, _, err = recountPoll(guid, false)
+	if err == nil {
+		_, err = db.Exec("UPDATE polls SET dirty = 1 WHERE guid = ?", guid)
+	}
+	if err != nil {
+		log.Printf("Error updating poll %s: %s", guid, err)
+	}
+}
+
+// recounts the votes of a poll, stores the question and federates it to followers and voters via Update
+func updatePoll(guid string, close bool) error {
+	db := app.App.DB
+	var name string
+	err := db.QueryRow("SELECT account FROM polls WHERE guid = ?", guid).Scan(&name)
+	if err != nil {
+		return err
+	}
+	// cleared first, so votes counted while the update is sent are federated the next time
+	_, err = db.Exec("UPDATE polls SET dirty = 0 WHERE guid = ?", guid)
+	if err != nil {
+		return err
+	}
+	questionObj, voters, err := recountPoll(guid, close)
+	if err != nil {
+		return err
+	}
+
+	// voters get the update too, even if they do not follow the account
+	followers, err := loadFollowers(name)
+	if err != nil {
+		return err
+	}
+	for _, voter := range voters {
+		if !slices.Contains(followers, voter) {
+			followers = append(followers, voter)
+		}
+	}
+	updateJSONStr, _ := json.Marshal(getUpdateObj(createGuid(), name, questionObj, questionObj.To, questionObj.CC))
+	deliverToFollowers(followers, updateJSONStr, name) // defined in send.go
+	return nil
+}
+
+// counts the votes of a poll per option and its voters, and stores the question with the counts, closed if asked
+func recountPoll(guid string, close bool) (Question, []string, error) {
+	db := app.App.DB
+	questionObj, err := getQuestion(guid)
+	if err != nil {
+		return Question{}, nil, err
+	}
+
+	// count votes per option and distinct voters
+	counts := make(map[string]int)
+	rows, err := db.Query("SELECT choice, COUNT(*) FROM poll_votes WHERE poll = ? GROUP BY choice", guid)
+	if err != nil {
+		return Question{}, nil, err
+	}
+	for rows.Next() {
+		var choice string
+		var count int
+		rows.Scan(&choice, &count)
+		counts[choice] = count
+	}
+	rows.Close()
+	var voters []string
+	rows, err = db.Query("SELECT DISTINCT voter FROM poll_votes WHERE poll = ?", guid)
+	if err != nil {
+		return Question{}, nil, err
+	}
+	for rows.Next() {
+		var voter string
+		rows.Scan(&voter)
+		voters = append(voters, voter)
+	}
+	rows.Close()
+
+	options := questionObj.options()
+	for i := range options {
+		options[i].Replies.TotalItems = counts[options[i].Name]
+	}
+	questionObj.VotersCount = len(voters)
+	if close {
+		questionObj.Closed = questionObj.EndTime
+		_, err = db.Exec("UPDATE polls SET closed = 1 WHERE guid = ?", guid)
+		if err != nil {
+			return Question{}, nil, err
+		}
+	}
+
+	questionJSONStr, _ := json.Marshal(questionObj)
+	_, err = db.Exec("UPDATE messages SET message = ? WHERE guid = ?", questionJSONStr, guid)
+	return questionObj, voters, err
+}
+
+// marks polls past their end time as closed and federates the counts of polls that got votes, every pollCloseInterval
+// so a poll sends at most one Update per interval however many votes it gets
+func StartPollCloser() {
+	go func() {
+		for range time.Tick(pollCloseInterval) {
+			closeExpiredPolls()
+			updateVotedPolls()
+		}
+	}()
+}
+
+func updateVotedPolls() {
+	db := app.App.DB
+	rows, err := db.Query("SELECT guid FROM polls WHERE dirty = 1 AND closed = 0")
+	if err != nil {
+		log.Println("Getting voted polls from db: ", err)
+		return
+	}
+	var guids []string
+	for rows.Next() {
+		var guid string
+		rows.Scan(&guid)
+		guids = append(guids, guid)
+	}
+	rows.Close()
+
+	for _, guid := range guids {
+		err = updatePoll(guid, false)
+		if err != nil {
+			log.Printf("Error updating poll %s: %s", guid, err)
+		}
+	}
+}
+
+func closeExpiredPolls() {
+	db := app.App.DB
+	now := time.Now().UTC().Format(time.RFC3339)
+	rows, err := db.Query("SELECT guid FROM polls WHERE closed = 0 AND end_time <= ?", now)
+	if err != nil {
+		log.Println("Getting expired polls from db: ", err)
+		return
+	}
+	var guids []string
+	for rows.Next() {
+		var guid string
+		rows.Scan(&guid)
+		guids = append(guids, guid)
+	}
+	rows.Close()
+
+	for _, guid := range guids {
+		err = updatePoll(guid, true)
+		if err != nil {
+			log.Printf("Error closing poll %s: %s", guid, err)
+		}
+	}
+}
+
+func getQuestion(guid string) (Question, error) {
+	db := app.App.DB
+	var questionJSONStr []byte
+	err := db.QueryRow("SELECT message FROM messages WHERE guid = ?", guid).Scan(&questionJSONStr)
+	if err != nil {
+		return Question{}, err
+	}
+	var questionObj Question
+	err = json.Unmarshal(questionJSONStr, &questionObj)
+	return questionObj, err
+}
+
+func getQuestionObj(guid string, msg string, name string, poll PollForm, visibility string) Question {
+	to, cc := getAddressing(name, visibility) // defined in send.go
+	options := make([]PollOption, len(poll.Options))
+	for i, option := range poll.Options {
+		options[i] = PollOption{
+			Type:    "Note",
+			Name:    option,
+			Replies: PollReplies{Type: "Collection", TotalItems: 0},
+		}
+	}
+	questionObj := Question{
+		ID:           fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:         "Question",
+		Published:    time.Now().UTC().Format(time.RFC3339),
+		AttributedTo: fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		Content:      msg,
+		To:           to,
+		CC:           cc,
+		EndTime:      poll.EndTime.Format(time.RFC3339),
+	}
+	if poll.Multiple {
+		questionObj.AnyOf = options
+	} else {
+		questionObj.OneOf = options
+	}
+	return questionObj
+}
+
+// to and cc are those of the object updated, so an Update never reaches further than the object did
+func getUpdateObj(guid string, name string, obj interface{}, to []string, cc []string) Activity {
+	return Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
+		Type:    "Update",
+		Actor:   fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
+		To:      to,
+		CC:      cc,
+		Object:  obj,
+	}
+}
+
+// returns the options of the poll, whichever of oneOf/anyOf it uses
+func (q Question) options() []PollOption {
+	if q.AnyOf != nil {
+		return q.AnyOf
+	}
+	return q.OneOf
+}
+
+type PollForm struct {
+	Options  []string  `json:"options"`
+	Multiple bool      `json:"multiple"`
+	EndTime  time.Time `json:"end_time"`
+}
+
+type Question struct {
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	Published    string       `json:"published"`
+	AttributedTo string       `json:"attributedTo"`
+	Content      string       `json:"content"`
+	To           []string     `json:"to"`
+	CC           []string     `json:"cc,omitempty"`
+	EndTime      string       `json:"endTime"`
+	Closed       string       `json:"closed,omitempty"`
+	OneOf        []PollOption `json:"oneOf,omitempty"`
+	AnyOf        []PollOption `json:"anyOf,omitempty"`
+	VotersCount  int          `json:"votersCount"`
+}
+
+type PollOption struct {
+	Type    string      `json:"type"`
+	Name    string      `json:"name"`
+	Replies PollReplies `json:"replies"`
+}
+
+type PollReplies struct {
+	Type       string `json:"type"`
+	TotalItems int    `json:"totalItems"`
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// report origins, reports are either received from another server or filed by our admins
+const (
+	reportReceived = "received"
+	reportFiled    = "filed"
+)
+
+// stores a Flag sent by another server about one of our accounts, once per Flag id
+// the object lists the reported actor followed by the reported posts, as Mastodon sends it
+// the reporter is the owner of the key the Flag was signed with, usually the instance actor of its server
+func handleFlag(activity InboxActivity, signer string, body []byte) {
+	if block, ok := getDomainBlock(uriHost(signer)); ok && block.RejectReports { // defined in domainblock.go
+		return
+	}
+	var flagObj struct {
+		Content string `json:"content"`
+	}
+	json.Unmarshal(body, &flagObj)
+
+	objects := referenceIDs(activity.Object) // defined in fetch.go
+	var target string
+	reported := make([]string, 0, len(objects))
+	for _, object := range objects {
+		if name, ok := localAccountName(object); ok && target == "" {
+			target = name
+			continue
+		}
+		reported = append(reported, object)
+	}
+	// the actor can be left out when posts are reported, it is then their author
+	if target == "" {
+		for _, object := range reported {
+			var name string
+			guid := strings.TrimPrefix(object, fmt.Sprintf("https://%s/m/", app.App.Domain))
+			if app.App.DB.QueryRow("SELECT account FROM messages WHERE guid = ?", guid).Scan(&name) == nil {
+				target = name
+				break
+			}
+		}
+	}
+	if target == "" || checkUserExists(target) != nil { // defined in inbox.go
+		return // not about one of our accounts
+	}
+
+	report := Report{
+		ID:         createGuid(),
+		Origin:     reportReceived,
+		ActivityID: activity.Id,
+		Reporter:   signer,
+		Target:     actorURI(target), // defined in instance.go
+		Account:    target,
+		Objects:    reported,
+		Comment:    flagObj.Content,
+	}
+	err := storeReport(report)
+	if errors.Is(err, errReportExists) {
+		return // a redelivered Flag
+	}
+	if err != nil {
+		log.Println("Storing report: ", err)
+		return
+	}
+	triggerWebhooks(target, webhookReport, signer, body) // defined in webhook.go
+}
+
+// lists reports, most recent first, optionally only those with the given status
+func ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	query := "SELECT id FROM reports ORDER BY created_at DESC"
+	args := []interface{}{}
+	if status != "" {
+		query = "SELECT id FROM reports WHERE status = ? ORDER BY created_at DESC"
+		args = append(args, status)
+	}
+
+	db := app.App.DB
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		handleErr(err, w, "reports")
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	reports := make([]Report, 0, len(ids))
+	for _, id := range ids {
+		report, err := loadReport(id)
+		if err != nil {
+			handleErr(err, w, id)
+			return
+		}
+		reports = append(reports, report)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reports)
+}
+
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	report, err := loadReport(id)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// assigns a report to the moderator given as 'assignee', or unassigns it if there is none
+func AssignReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	updateReport(w, id, "UPDATE reports SET assigned_to = ? WHERE id = ?", r.FormValue("assignee"), id)
+}
+
+func ResolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	updateReport(w, id, "UPDATE reports SET status = 'resolved', resolved_at = ? WHERE id = ?", time.Now().UTC().Format(time.RFC3339), id)
+}
+
+func ReopenReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	updateReport(w, id, "UPDATE reports SET status = 'open', resolved_at = NULL WHERE id = ?", id)
+}
+
+// adds a moderator note to a report, from the 'note' form value, signed with the 'author' form value or the admin's user name
+func ReportNoteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	note := r.FormValue("note")
+	if note == "" {
+		http.Error(w, "Bad request. Please send the text of the note as 'note'.", http.StatusBadRequest)
+		return
+	}
+	_, err := loadReport(id)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO report_notes(report, author, note, created_at) VALUES(?, ?, ?, ?)")
+	author := r.FormValue("author")
+	if author == "" {
+		author, _, _ = r.BasicAuth()
+	}
+	_, err = stmt.Exec(id, author, note, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// files a report against a remote actor with its home server, sent as a Flag from the instance actor
+// takes the actor as 'target', the reported posts as 'objects' and the reason as 'comment'
+func FileReportHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return
+	}
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "Bad request. Please send the URI of the actor to report as 'target'.", http.StatusBadRequest)
+		return
+	}
+	targetActor, err := fetchActor(target) // defined in fetch.go
+	if err != nil {
+		log.Println("Fetching reported actor: ", err)
+		http.Error(w, "Could not find the reported actor", http.StatusBadRequest)
+		return
+	}
+	if sameHost(targetActor.ID, actorURI(instanceName())) { // defined in secure.go
+		http.Error(w, "Only remote actors can be reported to their server", http.StatusBadRequest)
+		return
+	}
+
+	report := Report{
+		ID:      createGuid(),
+		Origin:  reportFiled,
+		Target:  targetActor.ID,
+		Objects: r.Form["objects"],
+		Comment: r.FormValue("comment"),
+	}
+	if report.Objects == nil {
+		report.Objects = []string{}
+	}
+	flagObj := getFlagObj(report)
+	report.ActivityID = flagObj.ID
+	report.Reporter = flagObj.Actor
+	err = storeReport(report)
+	if err != nil {
+		handleErr(err, w, report.ID)
+		return
+	}
+
+	// the report goes to the server rather than the reported actor, so a shared inbox is preferred
+	inbox := targetActor.Inbox
+	if targetActor.Endpoints.SharedInbox != "" {
+		inbox = targetActor.Endpoints.SharedInbox
+	}
+	flagJSONStr, _ := json.Marshal(flagObj)
+	deliverToInboxes([]string{inbox}, flagJSONStr, instanceName()) // defined in send.go
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"id": report.ID, "msg": "ok"})
+}
+
+// runs an update of a single report and responds, or 404s if there is no such report
+func updateReport(w http.ResponseWriter, id string, query string, args ...interface{}) {
+	db := app.App.DB
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleErr(sql.ErrNoRows, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+var errReportExists = errors.New("a report for this activity already exists")
+
+// stores a new report, unless there is already one for its activity id
+func storeReport(report Report) error {
+	objectsJSONStr, _ := json.Marshal(report.Objects)
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO reports(id, origin, activity_id, reporter, target, account, objects, comment, status, created_at) SELECT ?, ?, ?, ?, ?, ?, ?, ?, 'open', ? WHERE ? = '' OR NOT EXISTS (SELECT 1 FROM reports WHERE activity_id = ?)")
+	res, err := stmt.Exec(report.ID, report.Origin, report.ActivityID, report.Reporter, report.Target, report.Account, objectsJSONStr, report.Comment, time.Now().UTC().Format(time.RFC3339), report.ActivityID, report.ActivityID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errReportExists
+	}
+	return nil
+}
+
+func loadReport(id string) (Report, error) {
+	db := app.App.DB
+	var report Report
+	var objectsJSONStr []byte
+	var assignedTo, resolvedAt sql.NullString
+	err := db.QueryRow("SELECT id, origin, activity_id, reporter, target, account, objects, comment, status, assigned_to, created_at, resolved_at FROM reports WHERE id = ?", id).
+		Scan(&report.ID, &report.Origin, &report.ActivityID, &report.Reporter, &report.Target, &report.Account, &objectsJSONStr, &report.Comment, &report.Status, &assignedTo, &report.CreatedAt, &resolvedAt)
+	if err != nil {
+		return Report{}, err
+	}
+	json.Unmarshal(objectsJSONStr, &report.Objects)
+	report.AssignedTo = assignedTo.String
+	report.ResolvedAt = resolvedAt.String
+
+	rows, err := db.Query("SELECT author, note, created_at FROM report_notes WHERE report = ? ORDER BY created_at", id)
+	if err != nil {
+		return Report{}, err
+	}
+	defer rows.Close()
+	report.Notes = make([]ReportNote, 0)
+	for rows.Next() {
+		var note ReportNote
+		rows.Scan(&note.Author, &note.Note, &note.CreatedAt)
+		report.Notes = append(report.Notes, note)
+	}
+	return report, nil
+}
+
+// returns the name of a local account from its actor URI
+func localAccountName(uri string) (string, bool) {
+	prefix := fmt.Sprintf("https://%s/u/", app.App.Domain)
+	if !strings.HasPrefix(uri, prefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(uri, prefix)
+	return name, name != "" && !strings.Contains(name, "/")
+}
+
+func getFlagObj(report Report) FlagActivity {
+	return FlagActivity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      fmt.Sprintf("https://%s/m/%s", app.App.Domain, report.ID),
+		Type:    "Flag",
+		Actor:   actorURI(instanceName()),
+		Object:  append([]string{report.Target}, report.Objects...),
+		Content: report.Comment,
+	}
+}
+
+type FlagActivity struct {
+	Context string   `json:"@context"`
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Actor   string   `json:"actor"`
+	Object  []string `json:"object"`
+	Content string   `json:"content"`
+}
+
+type Report struct {
+	ID         string       `json:"id"`
+	Origin     string       `json:"origin"`
+	ActivityID string       `json:"activity_id"`
+	Reporter   string       `json:"reporter"`
+	Target     string       `json:"target"`
+	Account    string       `json:"account,omitempty"`
+	Objects    []string     `json:"objects"`
+	Comment    string       `json:"comment"`
+	Status     string       `json:"status"`
+	AssignedTo string       `json:"assigned_to,omitempty"`
+	CreatedAt  string       `json:"created_at"`
+	ResolvedAt string       `json:"resolved_at,omitempty"`
+	Notes      []ReportNote `json:"notes"`
+}
+
+type ReportNote struct {
+	Author    string `json:"author"`
+	Note      string `json:"note"`
+	CreatedAt string `json:"created_at"`
+}
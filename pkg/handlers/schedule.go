@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how often the scheduler checks for posts that are due
+const scheduleInterval = 10 * time.Second
+
+var errPollEnded = errors.New("the poll ended before it could be published")
+
+// stores a message (or poll) from a send request to be published at scheduledAt
+func schedulePost(msg string, name string, poll *PollForm, visibility string, scheduledAt time.Time) (string, error) {
+	var pollJSONStr []byte
+	if poll != nil {
+		pollJSONStr, _ = json.Marshal(poll)
+	}
+	guid := createGuid()
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO scheduled_posts(guid, account, message, poll, visibility, scheduled_at, status) VALUES(?, ?, ?, ?, ?, ?, 'scheduled')")
+	_, err := stmt.Exec(guid, name, msg, pollJSONStr, visibility, scheduledAt.UTC().Format(time.RFC3339))
+	return guid, err
+}
+
+// parses the scheduled_at form value, which must be an RFC 3339 timestamp in the future
+func parseScheduledAt(r *http.Request) (time.Time, error) {
+	scheduledAt, err := time.Parse(time.RFC3339, r.FormValue("scheduled_at"))
+	if err != nil {
+		return time.Time{}, errors.New("scheduled_at must be an RFC 3339 timestamp")
+	}
+	if !scheduledAt.After(time.Now()) {
+		return time.Time{}, errors.New("scheduled_at must be in the future")
+	}
+	return scheduledAt.UTC(), nil
+}
+
+func ScheduledListHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeRead) // defined in send.go
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	rows, err := db.Query("SELECT guid, message, poll, COALESCE(visibility, 'public'), scheduled_at, status, COALESCE(error, '') FROM scheduled_posts WHERE account = ? ORDER BY scheduled_at", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	posts := make([]ScheduledPost, 0)
+	for rows.Next() {
+		var post ScheduledPost
+		var pollJSONStr []byte
+		rows.Scan(&post.ID, &post.Message, &pollJSONStr, &post.Visibility, &post.ScheduledAt, &post.Status, &post.Error)
+		if len(pollJSONStr) > 0 {
+			post.Poll = &PollForm{}
+			json.Unmarshal(pollJSONStr, post.Poll)
+		}
+		posts = append(posts, post)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(posts)
+}
+
+func ScheduledCancelHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopePost) // defined in send.go
+	if !ok {
+		return
+	}
+	guid := mux.Vars(r)["id"]
+
+	db := app.App.DB
+	res, err := db.Exec("DELETE FROM scheduled_posts WHERE guid = ? AND account = ? AND status = 'scheduled'", guid, name)
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleErr(sql.ErrNoRows, w, guid)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+func ScheduledRescheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopePost) // defined in send.go
+	if !ok {
+		return
+	}
+	guid := mux.Vars(r)["id"]
+	scheduledAt, err := parseScheduledAt(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a scheduled poll must still end after it is published
+	db := app.App.DB
+	var pollJSONStr []byte
+	err = db.QueryRow("SELECT poll FROM scheduled_posts WHERE guid = ? AND account = ? AND status IN ('scheduled', 'failed')", guid, name).Scan(&pollJSONStr)
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	if len(pollJSONStr) > 0 {
+		var poll PollForm
+		json.Unmarshal(pollJSONStr, &poll)
+		if !poll.EndTime.After(scheduledAt) {
+			http.Error(w, "poll_end_time must be after scheduled_at", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// rescheduling a failed post queues it again, unless it was published or cancelled in the meantime
+	res, err := db.Exec("UPDATE scheduled_posts SET scheduled_at = ?, status = 'scheduled', error = NULL WHERE guid = ? AND account = ? AND status IN ('scheduled', 'failed')", scheduledAt.Format(time.RFC3339), guid, name)
+	if err != nil {
+		handleErr(err, w, guid)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "The post started publishing or was cancelled in the meantime", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// publishes scheduled posts once they are due, every scheduleInterval
+// posts that became due while the server was down are published on startup
+// posts left publishing when the server stopped may have reached some followers, so they are marked failed
+// rather than published again, and their accounts can reschedule them
+func StartScheduler() {
+	_, err := app.App.DB.Exec("UPDATE scheduled_posts SET status = 'failed', error = 'the server stopped while publishing the post' WHERE status = 'publishing'")
+	if err != nil {
+		log.Println("Resetting scheduled posts: ", err)
+	}
+	go func() {
+		publishDuePosts()
+		for range time.Tick(scheduleInterval) {
+			publishDuePosts()
+		}
+	}()
+}
+
+func publishDuePosts() {
+	db := app.App.DB
+	now := time.Now().UTC().Format(time.RFC3339)
+	rows, err := db.Query("SELECT guid, account, message, poll, COALESCE(visibility, 'public') FROM scheduled_posts WHERE status = 'scheduled' AND scheduled_at <= ?", now)
+	if err != nil {
+		log.Println("Getting due posts from db: ", err)
+		return
+	}
+	var due []ScheduledPost
+	for rows.Next() {
+		var post ScheduledPost
+		var pollJSONStr []byte
+		rows.Scan(&post.ID, &post.account, &post.Message, &pollJSONStr, &post.Visibility)
+		if len(pollJSONStr) > 0 {
+			post.Poll = &PollForm{}
+			json.Unmarshal(pollJSONStr, post.Poll)
+		}
+		due = append(due, post)
+	}
+	rows.Close()
+
+	for _, post := range due {
+		// claim the post first so it is never published twice
+		res, err := db.Exec("UPDATE scheduled_posts SET status = 'publishing' WHERE guid = ? AND status = 'scheduled'", post.ID)
+		if err != nil {
+			log.Println("Claiming scheduled post: ", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue // cancelled or rescheduled in the meantime
+		}
+
+		// a poll that ended while the server was down is not published as an open poll
+		if post.Poll != nil && !post.Poll.EndTime.After(time.Now()) {
+			err = errPollEnded
+		} else if post.Poll != nil {
+			err = sendPollToFollowers(post.Message, post.account, *post.Poll, post.Visibility) // defined in poll.go
+		} else {
+			err = sendMessageToFollowers(post.Message, post.account, post.Visibility) // defined in send.go
+		}
+		status, reason := "published", ""
+		if err != nil {
+			log.Printf("Error publishing scheduled post %s: %s", post.ID, err)
+			status, reason = "failed", err.Error()
+		}
+		_, err = db.Exec("UPDATE scheduled_posts SET status = ?, error = NULLIF(?, '') WHERE guid = ?", status, reason, post.ID)
+		if err != nil {
+			log.Println("Updating scheduled post status: ", err)
+		}
+	}
+}
+
+type ScheduledPost struct {
+	ID          string    `json:"id"`
+	Message     string    `json:"message"`
+	Poll        *PollForm `json:"poll,omitempty"`
+	Visibility  string    `json:"visibility"`
+	ScheduledAt string    `json:"scheduled_at"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"` // why a failed post was not published
+	account     string
+}
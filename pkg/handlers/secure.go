@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"ap-server/pkg/httpsig"
+	"ap-server/pkg/utils"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// in secure mode (AUTHORIZED_FETCH=true) our actors, collections and objects are only served to signed requests,
+// the same as Mastodon's authorized fetch
+func authorizedFetch() bool {
+	return os.Getenv("AUTHORIZED_FETCH") == "true"
+}
+
+// whether a request carries an HTTP signature in either format
+func isSigned(r *http.Request) bool {
+	return r.Header.Get("Signature") != "" || r.Header.Get("Signature-Input") != ""
+}
+
+// checks who is fetching one of our endpoints, responding with an error if they may not
+// in secure mode the request must be signed by an actor from a domain that is not blocked, otherwise signing is optional
+// returns the signer's actor URI, empty if the request is anonymous
+func checkFetchAccess(w http.ResponseWriter, r *http.Request) (string, bool) {
+	signer := ""
+	var err error
+	if isSigned(r) {
+		signer, err = verifySigner(r, nil)
+	}
+	if signer == "" {
+		if !authorizedFetch() {
+			return "", true // a bad signature only matters when one is required
+		}
+		if err != nil {
+			log.Printf("Rejecting signed fetch of %s: %s", r.URL.Path, err)
+		}
+		w.Header().Set("WWW-Authenticate", `Signature realm="activitypub"`)
+		http.Error(w, "A valid HTTP signature is required", http.StatusUnauthorized)
+		return "", false
+	}
+	if isDomainBlocked(uriHost(signer)) { // defined in domainblock.go
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return signer, true
+}
+
+// verifies the HTTP signature of a request, and the digest of its body if it has one
+// returns the URI of the actor that owns the key
+func verifySigner(r *http.Request, body []byte) (string, error) {
+	var owner string
+	_, err := httpsig.Verify(r, body, func(keyId string) (crypto.PublicKey, error) {
+		pubKey, keyOwner, err := resolveRemoteKey(keyId)
+		owner = keyOwner
+		return pubKey, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+// fetches the public key for a key id along with the actor owning it
+// the key id points either into an actor document (#main-key, an assertionMethod Multikey) or at a standalone key document
+func resolveRemoteKey(keyId string) (crypto.PublicKey, string, error) {
+	var doc RemoteKeyDocument
+	err := fetchJSON(keyId, &doc) // defined in fetch.go
+	if err != nil {
+		return nil, "", err
+	}
+
+	owner := doc.ID
+	var pemStr string
+	switch keyPem := doc.publicKeyPem(keyId); {
+	case keyPem != "":
+		pemStr = keyPem
+	case doc.ID == keyId && doc.PublicKeyPem != "":
+		owner, pemStr = doc.Owner, doc.PublicKeyPem
+	default:
+		for _, method := range doc.AssertionMethod {
+			if method.ID == keyId {
+				pubKey, err := utils.DecodeMultibaseEd25519(method.PublicKeyMultibase)
+				return pubKey, owner, err
+			}
+		}
+		if doc.ID != keyId || doc.PublicKeyMultibase == "" {
+			return nil, "", fmt.Errorf("no key %s in %s", keyId, doc.ID)
+		}
+		owner = doc.Controller
+	}
+
+	// a standalone key document may only speak for an actor on its own host
+	if !sameHost(owner, keyId) {
+		return nil, "", fmt.Errorf("key %s is not on the host of its owner %s", keyId, owner)
+	}
+	if pemStr == "" {
+		pubKey, err := utils.DecodeMultibaseEd25519(doc.PublicKeyMultibase)
+		return pubKey, owner, err
+	}
+	pubKey, err := utils.ParsePubKeyPEM(pemStr)
+	return pubKey, owner, err
+}
+
+func sameHost(uri string, other string) bool {
+	uriUrl, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	otherUrl, err := url.Parse(other)
+	if err != nil {
+		return false
+	}
+	return uriUrl.Host != "" && strings.EqualFold(uriUrl.Host, otherUrl.Host)
+}
+
+var errNotFollower = errors.New("not a follower")
+
+// allows a followers-only object only for a signer that follows its owner
+func checkFollowerAccess(name string, signer string) error {
+	if signer == "" {
+		return errNotFollower
+	}
+	followers, err := loadFollowers(name) // defined in user.go
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(followers, signer) {
+		return errNotFollower
+	}
+	return nil
+}
+
+// returns the PEM of the key with the given id from an actor's publicKey, which is one key or, while a
+// replaced key is still published, a list of them
+func (doc RemoteKeyDocument) publicKeyPem(keyId string) string {
+	var keys []RemotePublicKey
+	if json.Unmarshal(doc.PublicKey, &keys) != nil {
+		var key RemotePublicKey
+		json.Unmarshal(doc.PublicKey, &key)
+		keys = []RemotePublicKey{key}
+	}
+	for _, key := range keys {
+		if key.ID == keyId {
+			return key.PublicKeyPem
+		}
+	}
+	return ""
+}
+
+// shape shared by actor documents and standalone key documents, enough to find a key by its id
+type RemoteKeyDocument struct {
+	ID                 string          `json:"id"`
+	Owner              string          `json:"owner"`
+	Controller         string          `json:"controller"`
+	PublicKeyPem       string          `json:"publicKeyPem"`
+	PublicKeyMultibase string          `json:"publicKeyMultibase"`
+	PublicKey          json.RawMessage `json:"publicKey"`
+	AssertionMethod    []struct {
+		ID                 string `json:"id"`
+		PublicKeyMultibase string `json:"publicKeyMultibase"`
+	} `json:"assertionMethod"`
+}
+
+type RemotePublicKey struct {
+	ID           string `json:"id"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
@@ -2,31 +2,85 @@ package handlers
 
 import (
 	"ap-server/pkg/app"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"time"
 )
 
+var errNoFollowers = errors.New("no followers found")
+
+const (
+	visibilityPublic    = "public"
+	visibilityFollowers = "followers" // only delivered to followers and only served to them
+)
+
 func SendHandler(w http.ResponseWriter, r *http.Request) {
 	// parse request and verify API key for account
 	if err := r.ParseForm(); err != nil {
         http.Error(w, "Error parsing the form for send", http.StatusBadRequest)
         return
     }
-    key := r.FormValue("apikey")
-	name := r.FormValue("acct")
+	name, ok := checkAccountAuth(w, r, scopePost)
+	if !ok {
+		return
+	}
 	msg := r.FormValue("message")
-	
-	matched, err := checkAPIKey(key, name)
-	if err != nil || !matched {
-        http.Error(w, "API key error", http.StatusBadRequest)
-        return
-    }
 
-	// send message to all followers and add to messages database
-	sendMessageToFollowers(msg, name, w)
+	visibility, err := parseVisibility(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// polls are validated up front, so scheduled polls are rejected early too
+	var poll *PollForm
+	if len(r.Form["poll_options"]) > 0 {
+		parsedPoll, err := parsePollForm(r) // defined in poll.go
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		poll = &parsedPoll
+	}
+
+	// queue the message for the scheduler if a time is given
+	if r.FormValue("scheduled_at") != "" {
+		scheduledAt, err := parseScheduledAt(r) // defined in schedule.go
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if poll != nil && !poll.EndTime.After(scheduledAt) {
+			http.Error(w, "poll_end_time must be after scheduled_at", http.StatusBadRequest)
+			return
+		}
+		guid, err := schedulePost(msg, name, poll, visibility, scheduledAt)
+		if err != nil {
+			handleErr(err, w, name)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"id": guid, "msg": "ok"})
+		return
+	}
+
+	// send message (or poll) to all followers and add to messages database
+	if poll != nil {
+		err = sendPollToFollowers(msg, name, *poll, visibility)
+	} else {
+		err = sendMessageToFollowers(msg, name, visibility)
+	}
+	if err != nil {
+		handleSendErr(err, w, name)
+		return
+	}
 
 	// respond
 	w.Header().Set("Content-Type", "application/json")
@@ -39,76 +93,214 @@ func checkAPIKey(key string, name string) (bool, error) {
 	db := app.App.DB
 	domain := app.App.Domain
 	dbName := fmt.Sprintf("%s@%s", name, domain)
-	row := db.QueryRow("SELECT apikey FROM accounts WHERE name = ?", dbName)
+	row := db.QueryRow("SELECT apikey_hash, status FROM accounts WHERE name = ?", dbName)
 	
-	var dbKey string
-	err := row.Scan(&dbKey)
+	var dbKeyHash, status sql.NullString
+	err := row.Scan(&dbKeyHash, &status)
 	if err != nil {
 		return false, err
 	}
-	return dbKey == key, nil
+	// suspended and deleted accounts cannot use the API
+	if status.String == accountSuspended || status.String == accountDeleted { // defined in account.go
+		return false, nil
+	}
+	// only a hash of the key is stored, defined in token.go
+	return dbKeyHash.Valid && subtle.ConstantTimeCompare([]byte(dbKeyHash.String), []byte(hashToken(key))) == 1, nil
 }
 
 
-func sendMessageToFollowers(msg string, name string, w http.ResponseWriter) {
-	followers := getFollowers(w, name)
+// verifies that a request may act for an account within the scope, returns the account name
+// takes a token from an "Authorization: Bearer" header, or else the acct and apikey form values
+func checkAccountAuth(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing the form", http.StatusBadRequest)
+		return "", false
+	}
+	if token, ok := bearerToken(r); ok { // defined in token.go
+		name, err := checkToken(token, scope)
+		if err != nil {
+			writeTokenErr(w, err, scope)
+			return "", false
+		}
+		if acct := r.FormValue("acct"); acct != "" && acct != name {
+			writeTokenErr(w, errInvalidToken, scope)
+			return "", false
+		}
+		return name, true
+	}
+	key := r.FormValue("apikey")
+	name := r.FormValue("acct")
+	matched, err := checkAPIKey(key, name)
+	if err != nil || !matched {
+		http.Error(w, "API key error", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+
+// parses the visibility form value, public unless followers-only is asked for
+func parseVisibility(r *http.Request) (string, error) {
+	switch visibility := r.FormValue("visibility"); visibility {
+	case "":
+		return visibilityPublic, nil
+	case visibilityPublic, visibilityFollowers:
+		return visibility, nil
+	default:
+		return "", errors.New("visibility must be public or followers")
+	}
+}
+
+
+func sendMessageToFollowers(msg string, name string, visibility string) error {
+	visibility = effectiveVisibility(name, visibility) // defined in account.go
+	guidNote := createGuid()
+	noteObj := getNoteObj(guidNote, msg, name, visibility)
+	return publishToFollowers(guidNote, noteObj, name, visibility)
+}
+
+
+// wraps the object in a create activity, stores both in the messages database and sends the create to all followers
+func publishToFollowers(guidObj string, obj interface{}, name string, visibility string) error {
+	if isAccountSuspended(name) { // defined in account.go
+		return errAccountSuspended
+	}
+	followers, err := loadFollowers(name)
+	if err != nil {
+		return err
+	}
 	if len(followers) == 0 {
-		http.Error(w, "No followers found", http.StatusBadRequest)
+		return errNoFollowers
+	}
+
+	// get the create object for the object's create activity
+	guidCreate := createGuid()
+	createObj := getCreateObj(guidCreate, name, obj, visibility)
+
+	// add both objects' json str into messages database
+	objJSONStr, _ := json.Marshal(obj)
+	createJSONStr, _ := json.Marshal(createObj)
+	err = storeMessage(guidObj, objJSONStr, name, "")
+	if err != nil {
+		return err
+	}
+	err = storeMessage(guidCreate, createJSONStr, name, fmt.Sprintf("https://%s/m/%s", app.App.Domain, guidObj))
+	if err != nil {
+		return err
+	}
+
+	// sign and send the create activity
+	deliverToFollowers(followers, createJSONStr, name)
+	return nil
+}
+
+
+// adds an object or activity sent by the account to the messages database, object is the URI an activity acts on
+func storeMessage(guid string, msgJSONStr []byte, name string, object string) error {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(msgJSONStr, &typed)
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT OR REPLACE INTO messages(guid, message, account, type, object, published) VALUES(?, ?, ?, ?, ?, ?)")
+	_, err := stmt.Exec(guid, msgJSONStr, name, typed.Type, object, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+
+func deliverToFollowers(followers []string, msgJSONStr []byte, name string) {
+	followers = withoutBlocked(name, followers) // defined in block.go
+	inboxes := make([]string, len(followers))
+	for i, follower := range followers {
+		inboxes[i] = follower + "/inbox"
+	}
+	deliverToInboxes(inboxes, msgJSONStr, name)
+}
+
+
+func deliverToInboxes(inboxes []string, msgJSONStr []byte, name string) {
+	if isAccountSuspended(name) { // defined in account.go
+		log.Printf("Not delivering for suspended account %s", name)
 		return
 	}
-	for _, follower := range followers {
-		// get the note object
-		guidNote := createGuid()
-		noteObj := getNoteObj(guidNote, msg, name)
-		// get the create object for the note's create activity
-		guidCreate := createGuid()
-		createObj := getCreateObj(guidCreate, name, follower, noteObj)
-
-		// add both objects' json str into messages database
-		noteJSONStr, _ := json.Marshal(noteObj)
-		createJSONStr, _ := json.Marshal(createObj)
-		db := app.App.DB
-		stmt, _ := db.Prepare("INSERT OR REPLACE INTO messages(guid, message) VALUES(?, ?)")
-		_, err := stmt.Exec(guidNote, noteJSONStr)
-		if err != nil {
-			http.Error(w, "Error adding message", http.StatusInternalServerError)
+	msgJSONStr = addIntegrityProof(name, msgJSONStr) // defined in keys.go
+	for _, oppInbox := range inboxes {
+		inboxUrl, _ := url.Parse(oppInbox)
+		oppDomain := inboxUrl.Hostname()
+		err := signAndSend(oppInbox, oppDomain, msgJSONStr, name, app.App.Domain)
+		if err == errDomainBlocked { // defined in domainblock.go
+			continue // suspended domains are skipped quietly
 		}
-		_, err = stmt.Exec(guidCreate, createJSONStr)
 		if err != nil {
-			http.Error(w, "Error adding message", http.StatusInternalServerError)
+			log.Printf("Error sending to %s: %s", oppInbox, err)
 		}
+	}
+}
+
 
-		// sign and send the create activity
-		oppInbox := follower + "/inbox"
-		actorUrl, _ := url.Parse(follower)
-		oppDomain := actorUrl.Hostname()
-		signAndSendMsg(w, oppInbox, oppDomain, createJSONStr, name, app.App.Domain)
+func handleSendErr(err error, w http.ResponseWriter, name string) {
+	if err == errNoFollowers {
+		http.Error(w, "No followers found", http.StatusBadRequest)
+	} else {
+		handleErr(err, w, name) // defined in webfinger.go
 	}
 }
 
 
-func getNoteObj(guid string, msg string, name string) Note {
+func getNoteObj(guid string, msg string, name string, visibility string) Note {
+	to, cc := getAddressing(name, visibility)
 	return Note{
 		ID:           fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
 		Type:         "Note",
-		Published:    time.Now().UTC().Format(http.TimeFormat),
+		Published:    time.Now().UTC().Format(time.RFC3339),
 		AttributedTo: fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
 		Content:      msg,
-		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+		To:           to,
+		CC:           cc,
 	}
 }
 
 
-func getCreateObj(guid string, name string, follower string, noteObj Note) CreateActivity {
+func getCreateObj(guid string, name string, obj interface{}, visibility string) CreateActivity {
+	to, cc := getAddressing(name, visibility)
 	return CreateActivity{
 		Context:      "https://www.w3.org/ns/activitystreams",
 		ID:           fmt.Sprintf("https://%s/m/%s", app.App.Domain, guid),
 		Type:         "Create",
 		Actor:        fmt.Sprintf("https://%s/u/%s", app.App.Domain, name),
-		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
-		CC:           []string{follower},
-		Object:       noteObj,
+		To:           to,
+		CC:           cc,
+		Object:       obj,
+	}
+}
+
+
+// returns the to and cc of a post, followers-only posts are not addressed to the public collection
+func getAddressing(name string, visibility string) ([]string, []string) {
+	followersURI := fmt.Sprintf("https://%s/u/%s/followers", app.App.Domain, name)
+	if visibility == visibilityFollowers {
+		return []string{followersURI}, nil
+	}
+	return []string{"https://www.w3.org/ns/activitystreams#Public"}, []string{followersURI}
+}
+
+
+// whether a stored message may be shown to anyone, i.e. it is not a followers-only post
+func isPublicMessage(msgJSONStr []byte) bool {
+	var addressed struct {
+		To []string `json:"to"`
+		CC []string `json:"cc"`
+	}
+	json.Unmarshal(msgJSONStr, &addressed)
+	if len(addressed.To) == 0 && len(addressed.CC) == 0 {
+		return true // likes and the like carry no addressing
 	}
+	for _, recipient := range append(addressed.To, addressed.CC...) {
+		if recipient == "https://www.w3.org/ns/activitystreams#Public" {
+			return true
+		}
+	}
+	return false
 }
 
 
@@ -119,6 +311,20 @@ type Note struct {
     AttributedTo  string   `json:"attributedTo"`
     Content       string   `json:"content"`
     To            []string `json:"to"`
+    CC            []string `json:"cc,omitempty"`
+}
+
+
+// generic shape of the other activities we send that wrap an object (Update, Announce, Add, etc.)
+type Activity struct {
+    Context       string      `json:"@context"`
+    ID            string      `json:"id"`
+    Type          string      `json:"type"`
+    Actor         string      `json:"actor"`
+    To            []string    `json:"to,omitempty"`
+    CC            []string    `json:"cc,omitempty"`
+    Object        interface{} `json:"object"`
+    Target        string      `json:"target,omitempty"`
 }
 
 
@@ -128,6 +334,6 @@ type CreateActivity struct {
     Type          string      `json:"type"`
     Actor         string      `json:"actor"`
     To            []string    `json:"to"`
-    CC            []string    `json:"cc"`
-    Object        Note `json:"object"`
+    CC            []string    `json:"cc,omitempty"`
+    Object        interface{} `json:"object"`
 }
\ No newline at end of file
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// what a token can be used for
+const (
+	scopePost         = "post"          // sending, scheduling, boosting, liking and pinning posts
+	scopeFollow       = "follow"        // following and blocking
+	scopeRead         = "read"          // listing the account's blocks and scheduled posts
+	scopeAdminProfile = "admin-profile" // aliases and account migration
+	scopeTokens       = "tokens"        // managing tokens, only the account's API key has it
+)
+
+// the scopes a token can be given
+var tokenScopes = []string{scopePost, scopeFollow, scopeRead, scopeAdminProfile}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token has expired")
+	errTokenScope   = errors.New("token does not have the scope")
+)
+
+// creates a token for the account, named 'name', with the 'scopes' given (repeated or space separated)
+// and an optional 'expires_at'; the token is only shown in the response, the db keeps its hash
+func CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	tokenName := r.FormValue("name")
+	if tokenName == "" {
+		http.Error(w, "Bad request. Please name the token with 'name'.", http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(r.Form["scopes"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expiresAt sql.NullString
+	if r.FormValue("expires_at") != "" {
+		t, err := time.Parse(time.RFC3339, r.FormValue("expires_at"))
+		if err != nil || !t.After(time.Now()) {
+			http.Error(w, "expires_at must be an RFC 3339 timestamp in the future", http.StatusBadRequest)
+			return
+		}
+		expiresAt = sql.NullString{String: t.UTC().Format(time.RFC3339), Valid: true}
+	}
+
+	token := createToken()
+	id := createGuid()
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO tokens(id, account, name, hash, scopes, created_at, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	_, err = stmt.Exec(id, name, tokenName, hashToken(token), strings.Join(scopes, " "), time.Now().UTC().Format(time.RFC3339), expiresAt)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "token": token, "msg": "ok"})
+}
+
+// lists the account's tokens, without the tokens themselves
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	db := app.App.DB
+	rows, err := db.Query("SELECT id, name, scopes, created_at, expires_at, last_used_at, client_id FROM tokens WHERE account = ? ORDER BY created_at", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		var token Token
+		var scopes string
+		var expiresAt, lastUsedAt, clientID sql.NullString
+		rows.Scan(&token.ID, &token.Name, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt, &clientID)
+		token.Scopes = strings.Fields(scopes)
+		token.ExpiresAt = expiresAt.String
+		token.LastUsedAt = lastUsedAt.String
+		token.ClientID = clientID.String
+		tokens = append(tokens, token)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	db := app.App.DB
+	res, err := db.Exec("DELETE FROM tokens WHERE id = ? AND account = ?", id, name)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleErr(sql.ErrNoRows, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// returns the account a bearer token belongs to if it grants the scope
+// the account's API key works as a token with every scope
+func checkToken(token string, scope string) (string, error) {
+	db := app.App.DB
+	var name, scopes string
+	var expiresAt sql.NullString
+	err := db.QueryRow("SELECT account, scopes, expires_at FROM tokens WHERE hash = ?", hashToken(token)).Scan(&name, &scopes, &expiresAt)
+	if err == sql.ErrNoRows {
+		var dbName string
+		err = db.QueryRow("SELECT name FROM accounts WHERE apikey_hash = ?", hashToken(token)).Scan(&dbName)
+		if err == sql.ErrNoRows {
+			return "", errInvalidToken
+		}
+		if err != nil {
+			return "", err
+		}
+		name = strings.TrimSuffix(dbName, "@"+app.App.Domain)
+		scopes = strings.Join(tokenScopes, " ") + " " + scopeTokens
+	} else if err != nil {
+		return "", err
+	} else {
+		if expiresAt.Valid && expiresAt.String <= time.Now().UTC().Format(time.RFC3339) {
+			return "", errTokenExpired
+		}
+		_, err = db.Exec("UPDATE tokens SET last_used_at = ? WHERE hash = ?", time.Now().UTC().Format(time.RFC3339), hashToken(token))
+		if err != nil {
+			log.Println("Updating token last use: ", err)
+		}
+	}
+
+	if isAccountSuspended(name) { // defined in account.go
+		return "", errInvalidToken
+	}
+	if !slices.Contains(strings.Fields(scopes), scope) {
+		return "", errTokenScope
+	}
+	return name, nil
+}
+
+// returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// responds to a request whose bearer token was refused, as RFC 6750 describes
+func writeTokenErr(w http.ResponseWriter, err error, scope string) {
+	switch err {
+	case errTokenScope:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		http.Error(w, fmt.Sprintf("Token does not have the %s scope", scope), http.StatusForbidden)
+	case errInvalidToken, errTokenExpired:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+	default:
+		log.Println("Checking token: ", err)
+		http.Error(w, "Error checking token", http.StatusInternalServerError)
+	}
+}
+
+// splits the scopes form values, which may each hold several scopes separated by spaces or commas
+func parseScopes(values []string) ([]string, error) {
+	scopes := make([]string, 0)
+	for _, value := range values {
+		for _, scope := range strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' }) {
+			if !slices.Contains(tokenScopes, scope) {
+				return nil, fmt.Errorf("unknown scope %s, scopes are %s", scope, strings.Join(tokenScopes, ", "))
+			}
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("please give the token at least one of the scopes %s", strings.Join(tokenScopes, ", "))
+	}
+	return scopes, nil
+}
+
+// creates a random 64 character HEX string
+func createToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalln("Error creating token", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// tokens are random enough that a plain SHA-256 is enough to keep them from being read out of the db
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type Token struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	ClientID   string   `json:"client_id,omitempty"` // set for tokens issued to OAuth clients
+}
@@ -16,6 +16,26 @@ func UserNameHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+
+	// in secure mode unsigned requests only get what is needed to verify our signatures
+	if authorizedFetch() && !isSigned(r) { // defined in secure.go
+		actorObj, err := getStoredActor(name)
+		if err != nil {
+			handleErr(err, w, name)
+			return
+		}
+		minimalJSONStr, _ := json.Marshal(getMinimalActorObj(actorObj))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(withRetiredKeys(name, minimalJSONStr)) // defined in keys.go
+		return
+	}
+	_, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
 
 	db := app.App.DB
 	domain := app.App.Domain
@@ -29,9 +49,9 @@ func UserNameHandler(w http.ResponseWriter, r *http.Request) {
 		handleErr(err, w, name) // defined in webfinger.go
 		return
 	}
-	// send result
+	// send result, with replaced keys that verifiers may still look for in it
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(actorJSONStr)
+	w.Write(withRetiredKeys(name, actorJSONStr)) // defined in keys.go
 }
 
 
@@ -42,10 +62,18 @@ func UserFollowersHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+	_, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
 
 	// get the followers from db
 	// in db, followers is stored as a JSON string of the list of each follower's username, need to convert it to a followersCollection for response
 	followers := getFollowers(w, name)
+	followers = visibleFollowers(followers)
 	domain := app.App.Domain
 	followersCollectionObj := getFollowersCollectionObj(name, domain, followers)
 
@@ -57,7 +85,150 @@ func UserFollowersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// serves the activities sent by the user (creates and boosts) as an OrderedCollection
+// followers-only posts are left out unless the request is signed by a follower
+func UserOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := checkUserExists(name) // defined in inbox.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+	signer, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
+	isFollower := checkFollowerAccess(name, signer) == nil
+
+	db := app.App.DB
+	rows, err := db.Query("SELECT message FROM messages WHERE account = ? AND type IN ('Create', 'Announce') ORDER BY published DESC", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	activities := make([]json.RawMessage, 0)
+	for rows.Next() {
+		var activityJSONStr []byte
+		rows.Scan(&activityJSONStr)
+		if !isFollower && !isPublicMessage(activityJSONStr) { // defined in send.go
+			continue
+		}
+		activities = append(activities, activityJSONStr)
+	}
+
+	outboxObj := getOrderedCollectionObj(fmt.Sprintf("https://%s/u/%s/outbox", app.App.Domain, name), len(activities), activities)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(outboxObj)
+}
+
+
+// serves the URIs of the objects the user liked as an OrderedCollection
+func UserLikedHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := checkUserExists(name) // defined in inbox.go
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	if !checkAccountActive(w, name) { // defined in account.go
+		return
+	}
+	_, ok := checkFetchAccess(w, r) // defined in secure.go
+	if !ok {
+		return
+	}
+
+	db := app.App.DB
+	rows, err := db.Query("SELECT object FROM messages WHERE account = ? AND type = 'Like' ORDER BY published DESC", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	liked := make([]string, 0)
+	for rows.Next() {
+		var object string
+		rows.Scan(&object)
+		liked = append(liked, object)
+	}
+
+	likedObj := getOrderedCollectionObj(fmt.Sprintf("https://%s/u/%s/liked", app.App.Domain, name), len(liked), liked)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(likedObj)
+}
+
+
+// returns the actor object stored for the user
+func getStoredActor(name string) (Actor, error) {
+	db := app.App.DB
+	dbName := fmt.Sprintf("%s@%s", name, app.App.Domain)
+	var actorJSONStr []byte
+	err := db.QueryRow("SELECT actor FROM accounts WHERE name = ?", dbName).Scan(&actorJSONStr)
+	if err != nil {
+		return Actor{}, err
+	}
+	var actorObj Actor
+	err = json.Unmarshal(actorJSONStr, &actorObj)
+	return actorObj, err
+}
+
+
+// stores a changed actor object for the user and federates it to followers via Update
+func updateStoredActor(name string, actorObj Actor) error {
+	actorJSONStr, _ := json.Marshal(actorObj)
+	db := app.App.DB
+	dbName := fmt.Sprintf("%s@%s", name, app.App.Domain)
+	_, err := db.Exec("UPDATE accounts SET actor = ? WHERE name = ?", actorJSONStr, dbName)
+	if err != nil {
+		return err
+	}
+	return federateActor(name, actorObj)
+}
+
+
+// sends an Update with the user's actor object to its followers
+func federateActor(name string, actorObj Actor) error {
+	followers, err := loadFollowers(name)
+	if err != nil {
+		return err
+	}
+	to, cc := getAddressing(name, visibilityPublic) // defined in send.go
+	updateJSONStr, _ := json.Marshal(getUpdateObj(createGuid(), name, actorObj, to, cc)) // defined in poll.go
+	deliverToFollowers(followers, updateJSONStr, name) // defined in send.go
+	return nil
+}
+
+
 func getFollowers(w http.ResponseWriter, name string) []string {
+	followers, err := loadFollowers(name)
+	if err != nil { // handles no record found as well
+		handleErr(err, w, name) // defined in webfinger.go
+		return nil
+	}
+	return followers
+}
+
+
+// leaves out followers on silenced and suspended domains, which are not shown to others
+func visibleFollowers(followers []string) []string {
+	visible := make([]string, 0, len(followers))
+	for _, follower := range followers {
+		if !isDomainLimited(uriHost(follower)) { // defined in domainblock.go
+			visible = append(visible, follower)
+		}
+	}
+	return visible
+}
+
+
+// same as getFollowers, but reports errors to the caller instead of the client so it can run outside of a request
+func loadFollowers(name string) ([]string, error) {
 	db := app.App.DB
 	domain := app.App.Domain
 	dbName := fmt.Sprintf("%s@%s", name, domain)
@@ -65,16 +236,30 @@ func getFollowers(w http.ResponseWriter, name string) []string {
 	
 	var followersJSONStr []byte
 	err := row.Scan(&followersJSONStr)
-	if err != nil { // handles no record found as well
-		handleErr(err, w, name) // defined in webfinger.go
-		return nil
+	if err != nil {
+		return nil, err
 	}
 	var followers []string
     json.Unmarshal(followersJSONStr, &followers)
 	if len(string(followersJSONStr)) == 0 {
 		followers = make([]string, 0)
 	} // deal with case where followers row is NULL/not initialized (new account)
-	return followers
+	return followers, nil
+}
+
+
+// strips an actor down to what is needed to find its keys and deliver to it
+func getMinimalActorObj(actorObj Actor) MinimalActor {
+	return MinimalActor{
+		Context:           actorObj.Context,
+		ID:                actorObj.ID,
+		Type:              actorObj.Type,
+		PreferredUsername: actorObj.PreferredUsername,
+		Inbox:             actorObj.Inbox,
+		Outbox:            actorObj.Outbox,
+		PublicKey:         actorObj.PublicKey,
+		AssertionMethod:   actorObj.AssertionMethod,
+	}
 }
 
 
@@ -97,6 +282,40 @@ func getFollowersCollectionObj(name string, domain string, followers []string) F
 }
 
 
+func getOrderedCollectionObj(id string, totalItems int, items interface{}) OrderedCollection {
+	return OrderedCollection{
+		Context: []string{
+			"https://www.w3.org/ns/activitystreams",
+		},
+		ID: id,
+		Type: "OrderedCollection",
+		TotalItems: totalItems,
+		OrderedItems: items,
+	}
+}
+
+
+type OrderedCollection struct {
+	Context      []string    `json:"@context"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	TotalItems   int         `json:"totalItems"`
+	OrderedItems interface{} `json:"orderedItems"`
+}
+
+
+type MinimalActor struct {
+	Context           []interface{} `json:"@context"`
+	ID                string        `json:"id"`
+	Type              string        `json:"type"`
+	PreferredUsername string        `json:"preferredUsername"`
+	Inbox             string        `json:"inbox"`
+	Outbox            string        `json:"outbox"`
+	PublicKey         PublicKey     `json:"publicKey"`
+	AssertionMethod   []Multikey    `json:"assertionMethod,omitempty"`
+}
+
+
 type FollowersCollection struct {
     Type       string `json:"type"`
     TotalItems int    `json:"totalItems"`
@@ -19,14 +19,19 @@ func WebfingerHandler(w http.ResponseWriter, r *http.Request) {
 	// find webfinger record for account in db
 	name := strings.Replace(resource, "acct:", "", 1)
 	db := app.App.DB
-	row := db.QueryRow("SELECT webfinger FROM accounts WHERE name = ?", name)
+	row := db.QueryRow("SELECT webfinger, status FROM accounts WHERE name = ? COLLATE NOCASE", name)
 	
 	var webfingerJSONStr []byte
-	err := row.Scan(&webfingerJSONStr)
+	var status sql.NullString
+	err := row.Scan(&webfingerJSONStr, &status)
 	if err != nil { // handles no record found as well
 		handleErr(err, w, name)
 		return
 	}
+	if status.String == accountSuspended || status.String == accountDeleted { // defined in account.go
+		http.Error(w, fmt.Sprintf("%s is gone", name), http.StatusGone)
+		return
+	}
 	// send result
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(webfingerJSONStr)
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"ap-server/pkg/app"
+	"ap-server/pkg/fetch"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// the events a webhook can subscribe to, beyond the notification types
+const (
+	webhookUnfollow = "unfollow" // a follower undid its Follow
+	webhookReply    = "reply"    // a note replies to one of the account's posts, which is not also sent as a mention
+	webhookReport   = "report"   // the account or its posts were reported
+	webhookPing     = "ping"     // sent by the ping route to test a webhook, not subscribed to
+)
+
+var webhookEvents = []string{notificationFollow, webhookUnfollow, notificationMention, webhookReply, notificationLike, notificationBoost, webhookReport}
+
+const (
+	// how often the deliverer checks for deliveries that are due, new ones wake it up right away
+	webhookInterval = 10 * time.Second
+	// a failed delivery is retried after 30s, 2m, 8m, 32m and about 2h, then given up
+	webhookRetryDelay   = 30 * time.Second
+	webhookMaxAttempts  = 6
+	webhookDeliveryKept = 500 // per webhook, older finished deliveries are dropped as new ones are made
+)
+
+// webhooks are only posted to public addresses and redirects are not followed, as the URLs come from our users
+// and the events from remote servers
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: fetch.PublicTransport(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// wakes the deliverer when a delivery is queued
+var webhookWake = make(chan struct{}, 1)
+
+// subscribes a URL to the account's events, given by 'events' (repeated or comma separated); the payloads are
+// signed with 'secret', or with a random secret if none is given, which is only shown in the response
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	hookURL, err := url.Parse(r.FormValue("url"))
+	if err != nil || hookURL.Scheme != "https" || hookURL.Host == "" {
+		http.Error(w, "Bad request. Please give an https 'url'.", http.StatusBadRequest)
+		return
+	}
+	events, err := parseWebhookEvents(r.Form["events"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := r.FormValue("secret")
+	if secret == "" {
+		secret = createToken() // defined in token.go
+	} else if len(secret) < 16 {
+		http.Error(w, "secret must be at least 16 characters", http.StatusBadRequest)
+		return
+	}
+
+	hook := Webhook{
+		ID:        createGuid(),
+		URL:       hookURL.String(),
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO webhooks(id, account, url, events, secret, created_at) VALUES(?, ?, ?, ?, ?, ?)")
+	_, err = stmt.Exec(hook.ID, name, hook.URL, strings.Join(events, " "), secret, hook.CreatedAt)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// lists the account's webhooks, without their secrets
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	db := app.App.DB
+	rows, err := db.Query("SELECT id, url, events, created_at FROM webhooks WHERE account = ? ORDER BY created_at", name)
+	if err != nil {
+		handleErr(err, w, name)
+		return
+	}
+	defer rows.Close()
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		rows.Scan(&hook.ID, &hook.URL, &events, &hook.CreatedAt)
+		hook.Events = strings.Fields(events)
+		hooks = append(hooks, hook)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// removes a webhook and its deliveries, those still queued are not sent
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	db := app.App.DB
+	res, err := db.Exec("DELETE FROM webhooks WHERE id = ? AND account = ?", id, name)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleErr(sql.ErrNoRows, w, id)
+		return
+	}
+	_, err = db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"msg": "ok"})
+}
+
+// queues a ping event for the webhook, whose outcome shows in its deliveries
+func PingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	db := app.App.DB
+	var hookID string
+	err := db.QueryRow("SELECT id FROM webhooks WHERE id = ? AND account = ?", id, name).Scan(&hookID)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	deliveryID, err := queueWebhookDelivery(hookID, name, webhookPing, "", nil)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"id": deliveryID, "msg": "ok"})
+}
+
+// lists the most recent deliveries of a webhook, newest first, with their payloads
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := checkAccountAuth(w, r, scopeTokens) // defined in send.go
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	db := app.App.DB
+	var hookID string
+	err := db.QueryRow("SELECT id FROM webhooks WHERE id = ? AND account = ?", id, name).Scan(&hookID)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 50
+	}
+	rows, err := db.Query("SELECT id, event, payload, status, attempts, status_code, error, next_attempt_at, created_at, delivered_at FROM webhook_deliveries WHERE webhook_id = ? ORDER BY rowid DESC LIMIT ?", hookID, limit)
+	if err != nil {
+		handleErr(err, w, id)
+		return
+	}
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		var errStr, nextAttemptAt, deliveredAt sql.NullString
+		rows.Scan(&delivery.ID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts, &delivery.StatusCode, &errStr, &nextAttemptAt, &delivery.CreatedAt, &deliveredAt)
+		delivery.Payload = json.RawMessage(payload)
+		delivery.Error = errStr.String
+		if delivery.Status == "pending" {
+			delivery.NextAttemptAt = nextAttemptAt.String
+		}
+		delivery.DeliveredAt = deliveredAt.String
+		deliveries = append(deliveries, delivery)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// queues an event for the account's webhooks that subscribe to it, with the activity it came from
+// events for suspended accounts and from actors the account blocked are not sent
+func triggerWebhooks(name string, event string, actor string, activity json.RawMessage) {
+	if isAccountSuspended(name) || isBlocked(name, actor) { // defined in account.go and block.go
+		return
+	}
+	db := app.App.DB
+	rows, err := db.Query("SELECT id, events FROM webhooks WHERE account = ?", name)
+	if err != nil {
+		log.Println("Getting webhooks: ", err)
+		return
+	}
+	var hookIDs []string
+	for rows.Next() {
+		var hookID, events string
+		rows.Scan(&hookID, &events)
+		if slices.Contains(strings.Fields(events), event) {
+			hookIDs = append(hookIDs, hookID)
+		}
+	}
+	rows.Close()
+	for _, hookID := range hookIDs {
+		_, err = queueWebhookDelivery(hookID, name, event, actor, activity)
+		if err != nil {
+			log.Println("Queueing webhook delivery: ", err)
+		}
+	}
+}
+
+// stores the payload of an event for a webhook, to be sent by the deliverer, and returns its id
+func queueWebhookDelivery(hookID string, name string, event string, actor string, activity json.RawMessage) (string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	payload := WebhookPayload{
+		ID:        createGuid(),
+		Event:     event,
+		Account:   name,
+		Actor:     actor,
+		Activity:  activity,
+		CreatedAt: now,
+	}
+	payloadJSONStr, _ := json.Marshal(payload)
+	db := app.App.DB
+	stmt, _ := db.Prepare("INSERT INTO webhook_deliveries(id, webhook_id, account, event, payload, status, attempts, status_code, next_attempt_at, created_at) VALUES(?, ?, ?, ?, ?, 'pending', 0, 0, ?, ?)")
+	_, err := stmt.Exec(payload.ID, hookID, name, event, payloadJSONStr, now, now)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ? AND status != 'pending' AND rowid <= (SELECT rowid FROM webhook_deliveries WHERE webhook_id = ? ORDER BY rowid DESC LIMIT 1 OFFSET ?)",
+		hookID, hookID, webhookDeliveryKept)
+	if err != nil {
+		log.Println("Pruning webhook deliveries: ", err)
+	}
+	select {
+	case webhookWake <- struct{}{}:
+	default: // the deliverer is already woken up
+	}
+	return payload.ID, nil
+}
+
+// starts delivering queued webhook events in the background, picking up those that were being sent when the server stopped
+func StartWebhookDeliverer() {
+	_, err := app.App.DB.Exec("UPDATE webhook_deliveries SET status = 'pending' WHERE status = 'delivering'")
+	if err != nil {
+		log.Println("Requeueing webhook deliveries: ", err)
+	}
+	go func() {
+		ticker := time.NewTicker(webhookInterval)
+		for {
+			deliverDueWebhooks()
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			}
+		}
+	}()
+}
+
+func deliverDueWebhooks() {
+	db := app.App.DB
+	now := time.Now().UTC().Format(time.RFC3339)
+	rows, err := db.Query("SELECT d.id, d.payload, d.attempts, h.url, h.secret FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id WHERE d.status = 'pending' AND d.next_attempt_at <= ?", now)
+	if err != nil {
+		log.Println("Getting due webhook deliveries from db: ", err)
+		return
+	}
+	var due []webhookAttempt
+	for rows.Next() {
+		var attempt webhookAttempt
+		rows.Scan(&attempt.id, &attempt.payload, &attempt.attempts, &attempt.url, &attempt.secret)
+		due = append(due, attempt)
+	}
+	rows.Close()
+
+	for _, attempt := range due {
+		// claim the delivery first so it is never sent twice at once
+		res, err := db.Exec("UPDATE webhook_deliveries SET status = 'delivering' WHERE id = ? AND status = 'pending'", attempt.id)
+		if err != nil {
+			log.Println("Claiming webhook delivery: ", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		go deliverWebhook(attempt)
+	}
+}
+
+// posts the payload to the webhook's URL, then records the outcome and when to retry if it failed
+func deliverWebhook(attempt webhookAttempt) {
+	statusCode, err := postWebhook(attempt.url, attempt.secret, attempt.payload)
+	attempts := attempt.attempts + 1
+	now := time.Now().UTC()
+	var errStr sql.NullString
+	if err != nil {
+		errStr = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	db := app.App.DB
+	switch {
+	case err == nil:
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = 'delivered', attempts = ?, status_code = ?, error = NULL, delivered_at = ? WHERE id = ?",
+			attempts, statusCode, now.Format(time.RFC3339), attempt.id)
+	case attempts >= webhookMaxAttempts:
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = 'failed', attempts = ?, status_code = ?, error = ? WHERE id = ?",
+			attempts, statusCode, errStr, attempt.id)
+	default:
+		delay := webhookRetryDelay * time.Duration(math.Pow(4, float64(attempts-1)))
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = 'pending', attempts = ?, status_code = ?, error = ?, next_attempt_at = ? WHERE id = ?",
+			attempts, statusCode, errStr, now.Add(delay).Format(time.RFC3339), attempt.id)
+	}
+	if err != nil {
+		log.Println("Recording webhook delivery: ", err)
+	}
+}
+
+// posts a payload signed with the secret: X-Webhook-Signature is "sha256=" and the hex HMAC-SHA256 of the
+// X-Webhook-Timestamp, a dot and the body; any 2xx response counts as delivered
+func postWebhook(hookURL string, secret string, payload []byte) (int, error) {
+	var event struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+	}
+	json.Unmarshal(payload, &event)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	req, err := http.NewRequest("POST", hookURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	if req.URL.Scheme != "https" {
+		return 0, fmt.Errorf("refusing to post to %s, webhooks must use https", req.URL.Redacted())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("ap-server webhooks (https://%s)", app.App.Domain))
+	req.Header.Set("X-Webhook-Event", event.Event)
+	req.Header.Set("X-Webhook-Delivery", event.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// splits the events form values, which may each hold several events separated by spaces or commas
+func parseWebhookEvents(values []string) ([]string, error) {
+	events := make([]string, 0)
+	for _, value := range values {
+		for _, event := range strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' }) {
+			if !slices.Contains(webhookEvents, event) {
+				return nil, fmt.Errorf("unknown event %s, events are %s", event, strings.Join(webhookEvents, ", "))
+			}
+			if !slices.Contains(events, event) {
+				events = append(events, event)
+			}
+		}
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("please subscribe the webhook to at least one of the events %s", strings.Join(webhookEvents, ", "))
+	}
+	return events, nil
+}
+
+type webhookAttempt struct {
+	id       string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // only shown when the webhook is created
+	CreatedAt string   `json:"created_at"`
+}
+
+type WebhookPayload struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Account   string          `json:"account"`
+	Actor     string          `json:"actor,omitempty"`
+	Activity  json.RawMessage `json:"activity,omitempty"` // the activity received, as it was sent
+	CreatedAt string          `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID            string          `json:"id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // pending, delivering, delivered or failed
+	Attempts      int             `json:"attempts"`
+	StatusCode    int             `json:"status_code,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	NextAttemptAt string          `json:"next_attempt_at,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+	DeliveredAt   string          `json:"delivered_at,omitempty"`
+}
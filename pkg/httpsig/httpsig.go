@@ -0,0 +1,426 @@
+// Package httpsig signs and verifies HTTP requests with either the draft-cavage
+// Signature header used by most of the fediverse or RFC 9421 HTTP Message Signatures.
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+type Format string
+
+const (
+	Cavage         Format = "cavage"          // draft-cavage-http-signatures with rsa-sha256
+	RFC9421        Format = "rfc9421"         // RFC 9421 with rsa-v1_5-sha256
+	RFC9421Ed25519 Format = "rfc9421-ed25519" // RFC 9421 with ed25519
+)
+
+// how far a signature's date may be from now, same as Mastodon
+const maxClockSkew = 12 * time.Hour
+
+// the keys an actor can sign with, Ed25519 is optional
+type Key struct {
+	ID        string
+	RSA       *rsa.PrivateKey
+	Ed25519ID string
+	Ed25519   ed25519.PrivateKey
+}
+
+// looks up the public key (*rsa.PublicKey or ed25519.PublicKey) for a key id, e.g. by fetching the actor
+type KeyResolver func(keyId string) (crypto.PublicKey, error)
+
+// returns the formats to try for a host, most preferred first
+// a host's recorded format comes first, then RFC 9421 (with Ed25519 if there is a key for it), then draft-cavage
+func Formats(recorded Format, key Key) []Format {
+	formats := []Format{RFC9421, Cavage}
+	if key.Ed25519 != nil {
+		formats = append([]Format{RFC9421Ed25519}, formats...)
+	}
+	if recorded == "" {
+		return formats
+	}
+	ordered := []Format{recorded}
+	for _, format := range formats {
+		if format != recorded {
+			ordered = append(ordered, format)
+		}
+	}
+	return ordered
+}
+
+// signs a request in the given format, setting Date and (if there is a body) Digest and Content-Digest
+func Sign(req *http.Request, body []byte, key Key, format Format) error {
+	now := time.Now().UTC()
+	req.Header.Set("Date", now.Format(http.TimeFormat))
+	if body != nil {
+		hashedBody := sha256.Sum256(body)
+		digest := base64.StdEncoding.EncodeToString(hashedBody[:])
+		req.Header.Set("Digest", "SHA-256="+digest)
+		req.Header.Set("Content-Digest", "sha-256=:"+digest+":")
+	}
+
+	switch format {
+	case Cavage:
+		return signCavage(req, body, key)
+	case RFC9421:
+		return signRFC9421(req, body, key.ID, key.RSA, "rsa-v1_5-sha256", now)
+	case RFC9421Ed25519:
+		if key.Ed25519 == nil {
+			return errors.New("no Ed25519 key to sign with")
+		}
+		return signRFC9421(req, body, key.Ed25519ID, key.Ed25519, "ed25519", now)
+	}
+	return fmt.Errorf("unknown signature format %s", format)
+}
+
+func signCavage(req *http.Request, body []byte, key Key) error {
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		headers = append(headers, "digest")
+	}
+	stringToSign, err := cavageSigningString(req, headers)
+	if err != nil {
+		return err
+	}
+	signature, err := signWith(key.RSA, []byte(stringToSign))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`, key.ID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+func signRFC9421(req *http.Request, body []byte, keyId string, privKey crypto.Signer, alg string, created time.Time) error {
+	components := []string{"@method", "@target-uri"}
+	if body != nil {
+		components = append(components, "content-digest")
+	}
+	quoted := make([]string, len(components))
+	for i, component := range components {
+		quoted[i] = strconv.Quote(component)
+	}
+	params := fmt.Sprintf(`(%s);created=%d;keyid="%s";alg="%s"`, strings.Join(quoted, " "), created.Unix(), keyId, alg)
+	base, err := rfc9421SignatureBase(req, components, params)
+	if err != nil {
+		return err
+	}
+	signature, err := signWith(privKey, []byte(base))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature-Input", "sig1="+params)
+	req.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(signature)+":")
+	return nil
+}
+
+// verifies the signature of a request in either format, and if it has a body the digest the signature covers
+// returns the id of the key that signed it
+func Verify(req *http.Request, body []byte, resolve KeyResolver) (string, error) {
+	if req.Header.Get("Signature-Input") != "" {
+		return verifyRFC9421(req, body, resolve)
+	}
+	if req.Header.Get("Signature") != "" {
+		return verifyCavage(req, body, resolve)
+	}
+	return "", errors.New("request is not signed")
+}
+
+func verifyCavage(req *http.Request, body []byte, resolve KeyResolver) (string, error) {
+	params := parseCavageParams(req.Header.Get("Signature"))
+	keyId := params["keyId"]
+	if keyId == "" || params["signature"] == "" {
+		return "", errors.New("signature is missing keyId or signature")
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	if !slices.Contains(headers, "(request-target)") || !slices.Contains(headers, "date") {
+		return "", errors.New("signature must cover (request-target) and date")
+	}
+	if len(body) > 0 {
+		if !slices.Contains(headers, "digest") {
+			return "", errors.New("signature must cover the digest of the body")
+		}
+		err := verifyLegacyDigest(req.Header.Get("Digest"), body)
+		if err != nil {
+			return "", err
+		}
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil || !withinSkew(date) {
+		return "", errors.New("signature date is missing or too far from now")
+	}
+
+	stringToSign, err := cavageSigningString(req, headers)
+	if err != nil {
+		return "", err
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := resolve(keyId)
+	if err != nil {
+		return "", err
+	}
+	return keyId, verifyWith(pubKey, []byte(stringToSign), signature)
+}
+
+func verifyRFC9421(req *http.Request, body []byte, resolve KeyResolver) (string, error) {
+	// only the first signature is checked
+	member := strings.TrimSpace(firstDictMember(req.Header.Get("Signature-Input")))
+	label, params, ok := strings.Cut(member, "=")
+	if !ok {
+		return "", errors.New("malformed Signature-Input")
+	}
+	signature, err := rfc9421Signature(req.Header.Get("Signature"), label)
+	if err != nil {
+		return "", err
+	}
+
+	componentList, paramStr, ok := strings.Cut(strings.TrimPrefix(params, "("), ")")
+	if !ok {
+		return "", errors.New("malformed Signature-Input")
+	}
+	var components []string
+	for _, component := range strings.Fields(componentList) {
+		unquoted, err := strconv.Unquote(component)
+		if err != nil {
+			return "", err
+		}
+		components = append(components, unquoted)
+	}
+	sigParams := parseRFC9421Params(paramStr)
+	keyId := sigParams["keyid"]
+	if keyId == "" {
+		return "", errors.New("signature is missing keyid")
+	}
+	if !slices.Contains(components, "@method") || (!slices.Contains(components, "@target-uri") && !slices.Contains(components, "@path")) {
+		return "", errors.New("signature must cover the method and target")
+	}
+	if len(body) > 0 {
+		if !slices.Contains(components, "content-digest") {
+			return "", errors.New("signature must cover the content-digest of the body")
+		}
+		err := verifyContentDigest(req.Header.Get("Content-Digest"), body)
+		if err != nil {
+			return "", err
+		}
+	}
+	created, err := strconv.ParseInt(sigParams["created"], 10, 64)
+	if err != nil || !withinSkew(time.Unix(created, 0)) {
+		return "", errors.New("signature created time is missing or too far from now")
+	}
+
+	base, err := rfc9421SignatureBase(req, components, params)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := resolve(keyId)
+	if err != nil {
+		return "", err
+	}
+	return keyId, verifyWith(pubKey, []byte(base), signature)
+}
+
+func cavageSigningString(req *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, header := range headers {
+		switch header {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI())
+		case "host":
+			lines[i] = "host: " + requestHost(req)
+		default:
+			values := req.Header.Values(header)
+			if len(values) == 0 {
+				return "", fmt.Errorf("signed header %s is missing", header)
+			}
+			lines[i] = fmt.Sprintf("%s: %s", header, strings.Join(values, ", "))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func rfc9421SignatureBase(req *http.Request, components []string, params string) (string, error) {
+	var base strings.Builder
+	for _, component := range components {
+		var value string
+		switch component {
+		case "@method":
+			value = strings.ToUpper(req.Method)
+		case "@target-uri":
+			value = "https://" + requestHost(req) + req.URL.RequestURI()
+		case "@authority":
+			value = strings.ToLower(requestHost(req))
+		case "@path":
+			value = req.URL.EscapedPath()
+		case "@query":
+			value = "?" + req.URL.RawQuery
+		case "@request-target":
+			value = req.URL.RequestURI()
+		default:
+			if strings.HasPrefix(component, "@") {
+				return "", fmt.Errorf("unsupported component %s", component)
+			}
+			values := req.Header.Values(component)
+			if len(values) == 0 {
+				return "", fmt.Errorf("signed field %s is missing", component)
+			}
+			for i := range values {
+				values[i] = strings.TrimSpace(values[i])
+			}
+			value = strings.Join(values, ", ")
+		}
+		fmt.Fprintf(&base, "%q: %s\n", component, value)
+	}
+	fmt.Fprintf(&base, "\"@signature-params\": %s", params)
+	return base.String(), nil
+}
+
+// checks an RFC 9530 Content-Digest header, the one RFC 9421 signatures cover, against the body
+func verifyContentDigest(contentDigest string, body []byte) error {
+	for _, member := range strings.Split(contentDigest, ",") {
+		alg, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+		if alg == "sha-256" {
+			if strings.Trim(value, ":") != bodyDigest(body) {
+				return errors.New("Content-Digest does not match body")
+			}
+			return nil
+		}
+	}
+	return errors.New("Content-Digest has no sha-256 digest")
+}
+
+// checks a legacy RFC 3230 Digest header, the one draft-cavage signatures cover, against the body
+func verifyLegacyDigest(legacyDigest string, body []byte) error {
+	for _, member := range strings.Split(legacyDigest, ",") {
+		alg, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+		if strings.EqualFold(alg, "SHA-256") {
+			if value != bodyDigest(body) {
+				return errors.New("Digest does not match body")
+			}
+			return nil
+		}
+	}
+	return errors.New("Digest has no SHA-256 digest")
+}
+
+func bodyDigest(body []byte) string {
+	hashedBody := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(hashedBody[:])
+}
+
+func signWith(privKey crypto.Signer, data []byte) ([]byte, error) {
+	switch k := privKey.(type) {
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hashed[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, data), nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func verifyWith(pubKey crypto.PublicKey, data []byte, signature []byte) error {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return errors.New("ed25519 signature does not verify")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+// returns the host a request was made to, on both outgoing and incoming requests
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+func withinSkew(t time.Time) bool {
+	d := time.Since(t)
+	return d < maxClockSkew && d > -maxClockSkew
+}
+
+// parses the key="value" pairs of a draft-cavage Signature header
+func parseCavageParams(header string) map[string]string {
+	params := make(map[string]string)
+	for header != "" {
+		key, rest, ok := strings.Cut(header, "=")
+		if !ok {
+			break
+		}
+		key = strings.TrimSpace(key)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[key] = value
+		header = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return params
+}
+
+// parses the ;key=value parameters after the component list of a Signature-Input member
+func parseRFC9421Params(paramStr string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(paramStr, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// returns the first member of a structured field dictionary, ignoring commas inside quotes and inner lists
+func firstDictMember(header string) string {
+	inQuotes, depth := false, 0
+	for i, c := range header {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			return header[:i]
+		}
+	}
+	return header
+}
+
+// returns the signature bytes for a label from a Signature dictionary
+func rfc9421Signature(header string, label string) ([]byte, error) {
+	for _, member := range strings.Split(header, ",") {
+		memberLabel, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if ok && memberLabel == label {
+			return base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		}
+	}
+	return nil, fmt.Errorf("no signature for %s", label)
+}
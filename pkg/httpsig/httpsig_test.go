@@ -0,0 +1,173 @@
+package httpsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	testRSAKeyId     = "https://example.com/u/alice#main-key"
+	testEd25519KeyId = "https://example.com/u/alice#ed25519-key"
+)
+
+var allFormats = []Format{Cavage, RFC9421, RFC9421Ed25519}
+
+func testKey(t *testing.T) (Key, KeyResolver) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key{ID: testRSAKeyId, RSA: rsaKey, Ed25519ID: testEd25519KeyId, Ed25519: edPriv}
+	resolve := func(keyId string) (crypto.PublicKey, error) {
+		switch keyId {
+		case testRSAKeyId:
+			return &rsaKey.PublicKey, nil
+		case testEd25519KeyId:
+			return edPub, nil
+		}
+		return nil, errors.New("unknown key " + keyId)
+	}
+	return key, resolve
+}
+
+func signedRequest(t *testing.T, key Key, format Format, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", "https://remote.example/u/bob/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	err = Sign(req, body, key, format)
+	if err != nil {
+		t.Fatalf("%s: signing: %s", format, err)
+	}
+	return req
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	key, resolve := testKey(t)
+	body := []byte(`{"type":"Follow","actor":"https://example.com/u/alice"}`)
+	wantKeyIds := map[Format]string{Cavage: testRSAKeyId, RFC9421: testRSAKeyId, RFC9421Ed25519: testEd25519KeyId}
+	for _, format := range allFormats {
+		req := signedRequest(t, key, format, body)
+		keyId, err := Verify(req, body, resolve)
+		if err != nil {
+			t.Errorf("%s: verifying: %s", format, err)
+			continue
+		}
+		if keyId != wantKeyIds[format] {
+			t.Errorf("%s: got key id %s, want %s", format, keyId, wantKeyIds[format])
+		}
+	}
+}
+
+func TestVerifyRejectsTamperedBody(t *testing.T) {
+	key, resolve := testKey(t)
+	body := []byte(`{"type":"Create","content":"hello"}`)
+	for _, format := range allFormats {
+		req := signedRequest(t, key, format, body)
+		_, err := Verify(req, []byte(`{"type":"Create","content":"goodbye"}`), resolve)
+		if err == nil {
+			t.Errorf("%s: a request whose body changed verified", format)
+		}
+	}
+}
+
+func TestVerifyRejectsTamperedDigest(t *testing.T) {
+	key, resolve := testKey(t)
+	body := []byte(`{"type":"Create","content":"hello"}`)
+	forged := []byte(`{"type":"Create","content":"goodbye"}`)
+	for _, format := range allFormats {
+		// the digests match the forged body, but the signature covers the original ones
+		req := signedRequest(t, key, format, body)
+		req.Header.Set("Digest", "SHA-256="+bodyDigest(forged))
+		req.Header.Set("Content-Digest", "sha-256=:"+bodyDigest(forged)+":")
+		_, err := Verify(req, forged, resolve)
+		if err == nil {
+			t.Errorf("%s: a request with replaced digests verified", format)
+		}
+
+		// the signature covers a digest the body does not match
+		req = signedRequest(t, key, format, body)
+		req.Header.Set("Digest", "SHA-256="+bodyDigest(forged))
+		req.Header.Set("Content-Digest", "sha-256=:"+bodyDigest(forged)+":")
+		_, err = Verify(req, body, resolve)
+		if err == nil {
+			t.Errorf("%s: a request with a wrong digest verified", format)
+		}
+	}
+}
+
+func TestVerifyRejectsUncoveredDigest(t *testing.T) {
+	key, resolve := testKey(t)
+	body := []byte(`{"type":"Create","content":"hello"}`)
+	// signed as if there were no body, so no digest is covered
+	req := signedRequest(t, key, Cavage, nil)
+	_, err := Verify(req, body, resolve)
+	if err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("cavage: got %v, want an error about the digest", err)
+	}
+	req = signedRequest(t, key, RFC9421, nil)
+	_, err = Verify(req, body, resolve)
+	if err == nil || !strings.Contains(err.Error(), "content-digest") {
+		t.Errorf("rfc9421: got %v, want an error about the content-digest", err)
+	}
+}
+
+func TestVerifyRejectsTamperedTarget(t *testing.T) {
+	key, resolve := testKey(t)
+	body := []byte(`{"type":"Follow"}`)
+	for _, format := range allFormats {
+		req := signedRequest(t, key, format, body)
+		req.URL.Path = "/u/carol/inbox"
+		_, err := Verify(req, body, resolve)
+		if err == nil {
+			t.Errorf("%s: a request sent to another path verified", format)
+		}
+
+		req = signedRequest(t, key, format, body)
+		req.Host = "other.example"
+		_, err = Verify(req, body, resolve)
+		if err == nil {
+			t.Errorf("%s: a request sent to another host verified", format)
+		}
+	}
+}
+
+func TestVerifyRejectsUnsigned(t *testing.T) {
+	_, resolve := testKey(t)
+	req, _ := http.NewRequest("POST", "https://remote.example/u/bob/inbox", nil)
+	_, err := Verify(req, nil, resolve)
+	if err == nil {
+		t.Error("an unsigned request verified")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	key, _ := testKey(t)
+	got := Formats(Cavage, key)
+	want := []Format{Cavage, RFC9421Ed25519, RFC9421}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	key.Ed25519 = nil
+	got = Formats("", key)
+	want = []Format{RFC9421, Cavage}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
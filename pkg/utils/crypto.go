@@ -1,14 +1,23 @@
 package utils
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 )
 
+// default size of the RSA keys we generate
+const DefaultKeyBits = 4096
+
 func GetEncodedKeys() (privKey string, pubKey string) {
-    privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+    return GetEncodedKeysWithBits(DefaultKeyBits)
+}
+
+func GetEncodedKeysWithBits(bits int) (privKey string, pubKey string) {
+    privateKey, err := rsa.GenerateKey(rand.Reader, bits)
     if err != nil {
         panic(err)
     }
@@ -34,4 +43,16 @@ func GetEncodedKeys() (privKey string, pubKey string) {
     )
 
 	return string(privateKeyPEM), string(publicKeyPEM)
-}
\ No newline at end of file
+}
+
+// parses a PEM encoded public key, either PKIX ("PUBLIC KEY") or PKCS#1 ("RSA PUBLIC KEY") as some servers still publish
+func ParsePubKeyPEM(pubKeyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid public key PEM")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
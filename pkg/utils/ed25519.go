@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// multicodec prefix of an Ed25519 public key (varint of 0xed)
+var ed25519MulticodecPrefix = []byte{0xed, 0x01}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// creates an Ed25519 keypair, returns the PKCS #8 PEM private key and the multibase public key
+func GetEd25519Keys() (privKey string, pubKeyMultibase string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		panic(err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: privateKeyDER,
+		},
+	)
+	return string(privateKeyPEM), EncodeMultibaseEd25519(publicKey)
+}
+
+func ParseEd25519PrivKeyPEM(privKeyPEM string) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privKeyPEM))
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("PEM block is not an Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// encodes a public key as publicKeyMultibase for a Multikey (base58btc with the Ed25519 multicodec prefix)
+func EncodeMultibaseEd25519(publicKey ed25519.PublicKey) string {
+	return "z" + EncodeBase58(append(append([]byte{}, ed25519MulticodecPrefix...), publicKey...))
+}
+
+func DecodeMultibaseEd25519(multibase string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(multibase, "z") {
+		return nil, errors.New("only base58btc multibase keys are supported")
+	}
+	decoded, err := DecodeBase58(multibase[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != len(ed25519MulticodecPrefix)+ed25519.PublicKeySize || decoded[0] != ed25519MulticodecPrefix[0] || decoded[1] != ed25519MulticodecPrefix[1] {
+		return nil, errors.New("multibase value is not an Ed25519 public key")
+	}
+	return ed25519.PublicKey(decoded[len(ed25519MulticodecPrefix):]), nil
+}
+
+func EncodeBase58(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are kept as leading '1's
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func DecodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, errors.New("invalid base58 character")
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	out := n.Bytes()
+	for _, c := range s {
+		if c != rune(base58Alphabet[0]) {
+			break
+		}
+		out = append([]byte{0}, out...)
+	}
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// keeps RSA keypairs generated ahead of time so account creation does not wait for one
+// keys are refilled in the background as they are taken; an empty pool generates synchronously
+type KeyPool struct {
+	keys chan keyPair
+	size int
+	bits int
+
+	mu              sync.Mutex
+	generated       int64
+	hits            int64
+	misses          int64
+	totalGeneration time.Duration
+	lastGeneration  time.Duration
+}
+
+type keyPair struct {
+	privKey string
+	pubKey  string
+}
+
+// creates a pool holding up to size keys of the given bits and starts filling it
+// a size of 0 disables pooling, every key is then generated when it is asked for
+func NewKeyPool(size int, bits int) *KeyPool {
+	p := &KeyPool{
+		keys: make(chan keyPair, size),
+		size: size,
+		bits: bits,
+	}
+	workers := runtime.NumCPU()
+	if workers > size {
+		workers = size
+	}
+	for i := 0; i < workers; i++ {
+		go p.refill()
+	}
+	return p
+}
+
+// returns a PEM encoded keypair, from the pool if one is ready
+func (p *KeyPool) Get() (privKey string, pubKey string) {
+	select {
+	case pair := <-p.keys:
+		p.mu.Lock()
+		p.hits++
+		p.mu.Unlock()
+		return pair.privKey, pair.pubKey
+	default:
+		p.mu.Lock()
+		p.misses++
+		p.mu.Unlock()
+		pair := p.generate()
+		return pair.privKey, pair.pubKey
+	}
+}
+
+// generates keys until the pool is full, then blocks until one is taken
+func (p *KeyPool) refill() {
+	for {
+		p.keys <- p.generate()
+	}
+}
+
+func (p *KeyPool) generate() keyPair {
+	start := time.Now()
+	privKey, pubKey := GetEncodedKeysWithBits(p.bits)
+	elapsed := time.Since(start)
+
+	p.mu.Lock()
+	p.generated++
+	p.totalGeneration += elapsed
+	p.lastGeneration = elapsed
+	p.mu.Unlock()
+	return keyPair{privKey: privKey, pubKey: pubKey}
+}
+
+func (p *KeyPool) Stats() KeyPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := KeyPoolStats{
+		Size:             p.size,
+		Depth:            len(p.keys),
+		Bits:             p.bits,
+		Generated:        p.generated,
+		Hits:             p.hits,
+		Misses:           p.misses,
+		LastGenerationMs: p.lastGeneration.Milliseconds(),
+	}
+	if p.generated > 0 {
+		stats.AvgGenerationMs = (p.totalGeneration / time.Duration(p.generated)).Milliseconds()
+	}
+	return stats
+}
+
+type KeyPoolStats struct {
+	Size             int   `json:"size"`
+	Depth            int   `json:"depth"`
+	Bits             int   `json:"bits"`
+	Generated        int64 `json:"generated"`
+	Hits             int64 `json:"hits"`
+	Misses           int64 `json:"misses"`
+	AvgGenerationMs  int64 `json:"avg_generation_ms"`
+	LastGenerationMs int64 `json:"last_generation_ms"`
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefix of sealed values, so plaintext keys from before encryption was enabled can still be read
+const sealedPrefix = "enc:v1:"
+
+// seals private keys with AES-GCM under a master key before they are stored, and opens them for signing
+// a KeyStore without a master key stores keys as plaintext
+type KeyStore struct {
+	aead cipher.AEAD
+}
+
+// creates a KeyStore from a 32 byte master key, or a plaintext one if masterKey is nil
+func NewKeyStore(masterKey []byte) (*KeyStore, error) {
+	if masterKey == nil {
+		return &KeyStore{}, nil
+	}
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{aead: aead}, nil
+}
+
+// reads a base64 master key from the env var, or from the file named by the env var with a _FILE suffix
+// returns nil if neither is set
+func LoadMasterKey(envVar string) ([]byte, error) {
+	encoded := os.Getenv(envVar)
+	if path := os.Getenv(envVar + "_FILE"); encoded == "" && path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(contents)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// creates a random master key, base64 encoded for MASTER_KEY
+func GenerateMasterKey() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (k *KeyStore) Encrypted() bool {
+	return k.aead != nil
+}
+
+// seals a private key, bound to the owner (e.g. the account name) so it cannot be swapped onto another row
+func (k *KeyStore) Seal(privKey string, owner string) (string, error) {
+	if k.aead == nil {
+		return privKey, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(privKey), []byte(owner))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// opens a private key sealed for owner, plaintext keys are returned as they are
+func (k *KeyStore) Open(stored string, owner string) (string, error) {
+	if !IsSealed(stored) {
+		return stored, nil
+	}
+	if k.aead == nil {
+		return "", errors.New("private key is encrypted but no master key is configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("sealed private key is too short")
+	}
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(owner))
+	if err != nil {
+		return "", errors.New("could not decrypt private key, is the master key correct?")
+	}
+	return string(plain), nil
+}
+
+func IsSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
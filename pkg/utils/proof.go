@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const dataIntegrityContext = "https://w3id.org/security/data-integrity/v1"
+
+// adds an eddsa-jcs-2022 Data Integrity proof (FEP-8b32) to a JSON document, replacing any existing proof
+func AddIntegrityProof(doc []byte, verificationMethod string, privateKey ed25519.PrivateKey) ([]byte, error) {
+	var document map[string]interface{}
+	err := json.Unmarshal(doc, &document)
+	if err != nil {
+		return nil, err
+	}
+	delete(document, "proof")
+	document["@context"] = withDataIntegrityContext(document["@context"])
+
+	proof := map[string]interface{}{
+		"@context":           document["@context"],
+		"type":               "DataIntegrityProof",
+		"cryptosuite":        "eddsa-jcs-2022",
+		"verificationMethod": verificationMethod,
+		"proofPurpose":       "assertionMethod",
+		"created":            time.Now().UTC().Format(time.RFC3339),
+	}
+	hashData, err := proofHashData(document, proof)
+	if err != nil {
+		return nil, err
+	}
+	// the document's context is implied on the attached proof
+	delete(proof, "@context")
+	proof["proofValue"] = "z" + EncodeBase58(ed25519.Sign(privateKey, hashData))
+	document["proof"] = proof
+	return CanonicalJSON(document)
+}
+
+// checks the eddsa-jcs-2022 proof of a JSON document against the public key of its verificationMethod
+func VerifyIntegrityProof(doc []byte, publicKey ed25519.PublicKey) error {
+	var document map[string]interface{}
+	err := json.Unmarshal(doc, &document)
+	if err != nil {
+		return err
+	}
+	proof, ok := document["proof"].(map[string]interface{})
+	if !ok || proof["cryptosuite"] != "eddsa-jcs-2022" {
+		return errors.New("document has no eddsa-jcs-2022 proof")
+	}
+	proofValue, _ := proof["proofValue"].(string)
+	if !strings.HasPrefix(proofValue, "z") {
+		return errors.New("proofValue must be base58btc multibase")
+	}
+	signature, err := DecodeBase58(proofValue[1:])
+	if err != nil {
+		return err
+	}
+
+	delete(document, "proof")
+	delete(proof, "proofValue")
+	if context, ok := document["@context"]; ok {
+		proof["@context"] = context
+	}
+	hashData, err := proofHashData(document, proof)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, hashData, signature) {
+		return errors.New("integrity proof does not verify")
+	}
+	return nil
+}
+
+func proofHashData(document map[string]interface{}, proofConfig map[string]interface{}) ([]byte, error) {
+	canonicalProof, err := CanonicalJSON(proofConfig)
+	if err != nil {
+		return nil, err
+	}
+	canonicalDocument, err := CanonicalJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	proofHash := sha256.Sum256(canonicalProof)
+	documentHash := sha256.Sum256(canonicalDocument)
+	return append(proofHash[:], documentHash[:]...), nil
+}
+
+// adds the data integrity context to a document's @context, which can be a string or a list
+func withDataIntegrityContext(context interface{}) interface{} {
+	switch c := context.(type) {
+	case nil:
+		return dataIntegrityContext
+	case []interface{}:
+		for _, entry := range c {
+			if entry == dataIntegrityContext {
+				return c
+			}
+		}
+		return append(c, dataIntegrityContext)
+	default:
+		if c == dataIntegrityContext {
+			return c
+		}
+		return []interface{}{c, dataIntegrityContext}
+	}
+}
+
+// serializes a JSON value following RFC 8785, the JSON Canonicalization Scheme (JCS): object members sorted by
+// the UTF-16 code units of their names, no insignificant whitespace, strings with only the escapes JCS requires
+// and numbers as ECMAScript prints them
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeCanonical(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(value))
+	case float64:
+		number, err := canonicalNumber(value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(number)
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		return writeCanonical(buf, f)
+	case string:
+		writeCanonicalString(buf, value)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, element := range value {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeCanonical(buf, element)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return lessUTF16(names[i], names[j]) })
+		buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, name)
+			buf.WriteByte(':')
+			err := writeCanonical(buf, value[name])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		// other Go values are brought to the shapes above through encoding/json
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var decoded interface{}
+		err = json.Unmarshal(encoded, &decoded)
+		if err != nil {
+			return err
+		}
+		return writeCanonical(buf, decoded)
+	}
+	return nil
+}
+
+// escapes only quotation marks, backslashes and control characters, the latter with the short forms where
+// there are some, and writes everything else (including <, >, &, U+2028 and U+2029) as UTF-8
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// formats a number as ECMAScript's Number.prototype.toString does: the shortest digits that round-trip,
+// in plain notation from 1e-6 up to 1e21 and in exponential notation (e.g. 1e+21, 1.5e-7) outside of it
+func canonicalNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", errors.New("NaN and infinite numbers have no JSON form")
+	}
+	if f == 0 {
+		return "0", nil // negative zero too
+	}
+	if abs := math.Abs(f); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	// Go pads the exponent to two digits, ECMAScript does not
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	return mantissa + "e" + exponent[:1] + strings.TrimLeft(exponent[1:], "0"), nil
+}
+
+// compares strings by their UTF-16 code units, the order JCS sorts object members in
+func lessUTF16(a string, b string) bool {
+	unitsA, unitsB := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(unitsA) && i < len(unitsB); i++ {
+		if unitsA[i] != unitsB[i] {
+			return unitsA[i] < unitsB[i]
+		}
+	}
+	return len(unitsA) < len(unitsB)
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// the number serialization samples of RFC 8785 appendix B, IEEE 754 bits and their canonical form
+var rfc8785Numbers = []struct {
+	bits string
+	want string
+}{
+	{"0000000000000000", "0"},
+	{"8000000000000000", "0"},
+	{"0000000000000001", "5e-324"},
+	{"8000000000000001", "-5e-324"},
+	{"7fefffffffffffff", "1.7976931348623157e+308"},
+	{"ffefffffffffffff", "-1.7976931348623157e+308"},
+	{"4340000000000000", "9007199254740992"},
+	{"c340000000000000", "-9007199254740992"},
+	{"4430000000000000", "295147905179352830000"},
+	{"44b52d02c7e14af5", "9.999999999999997e+22"},
+	{"44b52d02c7e14af6", "1e+23"},
+	{"44b52d02c7e14af7", "1.0000000000000001e+23"},
+	{"444b1ae4d6e2ef4e", "999999999999999700000"},
+	{"444b1ae4d6e2ef4f", "999999999999999900000"},
+	{"444b1ae4d6e2ef50", "1e+21"},
+	{"3eb0c6f7a0b5ed8c", "9.999999999999997e-7"},
+	{"3eb0c6f7a0b5ed8d", "0.000001"},
+	{"41b3de4355555553", "333333333.3333332"},
+	{"41b3de4355555554", "333333333.33333325"},
+	{"41b3de4355555555", "333333333.3333333"},
+	{"41b3de4355555556", "333333333.3333334"},
+	{"41b3de4355555557", "333333333.33333343"},
+	{"becbf647612f3696", "-0.0000033333333333333333"},
+	{"43143ff3c1cb0959", "1424953923781206.2"},
+}
+
+func TestCanonicalNumbers(t *testing.T) {
+	for _, sample := range rfc8785Numbers {
+		bits, _ := hex.DecodeString(sample.bits)
+		f := math.Float64frombits(binary.BigEndian.Uint64(bits))
+		got, err := CanonicalJSON(f)
+		if err != nil {
+			t.Errorf("%s: %s", sample.bits, err)
+			continue
+		}
+		if string(got) != sample.want {
+			t.Errorf("%s: got %s, want %s", sample.bits, got, sample.want)
+		}
+	}
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := CanonicalJSON(f); err == nil {
+			t.Errorf("%v has no JSON form but was serialized", f)
+		}
+	}
+}
+
+// the example of RFC 8785 section 3.2.2
+func TestCanonicalJSON(t *testing.T) {
+	input := `{
+		"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+		"string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+		"literals": [null, true, false]
+	}`
+	want := `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`
+	var v interface{}
+	err := json.Unmarshal([]byte(input), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := CanonicalJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+// the property sorting example of RFC 8785 section 3.2.3, where UTF-16 order differs from UTF-8 order
+func TestCanonicalJSONSorting(t *testing.T) {
+	input := `{
+		"\u20ac": "Euro Sign",
+		"\r": "Carriage Return",
+		"\ufb33": "Hebrew Letter Dalet With Dagesh",
+		"1": "One",
+		"\ud83d\ude00": "Emoji: Grinning Face",
+		"\u0080": "Control",
+		"\u00f6": "Latin Small Letter O With Diaeresis"
+	}`
+	want := []string{
+		"Carriage Return",
+		"One",
+		"Control",
+		"Latin Small Letter O With Diaeresis",
+		"Euro Sign",
+		"Emoji: Grinning Face",
+		"Hebrew Letter Dalet With Dagesh",
+	}
+	var v interface{}
+	err := json.Unmarshal([]byte(input), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := CanonicalJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := -1
+	for _, value := range want {
+		i := strings.Index(string(got), `"`+value+`"`)
+		if i < last {
+			t.Errorf("%q is out of order in %s", value, got)
+		}
+		last = i
+	}
+	if !strings.HasPrefix(string(got), `{"\r":"Carriage Return","1":"One","`+"\u0080"+`":"Control"`) {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestIntegrityProofRoundTrip(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`{"@context":"https://www.w3.org/ns/activitystreams","type":"Create","actor":"https://example.com/u/alice","object":{"type":"Note","content":"a < b & €"}}`)
+	signed, err := AddIntegrityProof(doc, "https://example.com/u/alice#ed25519-key", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyIntegrityProof(signed, publicKey)
+	if err != nil {
+		t.Fatalf("a signed document does not verify: %s", err)
+	}
+
+	// the proof covers the document whatever the order and spacing of its members
+	var reordered map[string]interface{}
+	json.Unmarshal(signed, &reordered)
+	reorderedJSON, _ := json.MarshalIndent(reordered, "", "  ")
+	err = VerifyIntegrityProof(reorderedJSON, publicKey)
+	if err != nil {
+		t.Errorf("a reformatted document does not verify: %s", err)
+	}
+
+	tampered := strings.Replace(string(signed), "a < b", "a > b", 1)
+	if VerifyIntegrityProof([]byte(tampered), publicKey) == nil {
+		t.Error("a changed document verified")
+	}
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if VerifyIntegrityProof(signed, otherKey) == nil {
+		t.Error("a document verified with another key")
+	}
+	if VerifyIntegrityProof(doc, publicKey) == nil {
+		t.Error("a document without a proof verified")
+	}
+}